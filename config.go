@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// config is the contents of a configuration file, as passed with -config.
+//
+// Example:
+//
+//	bridges:
+//	  - telegram_chat: -1001234567890
+//	    irc_server: irc.libera.chat:6667
+//	    irc_channel: "#hackerspace-pl"
+//	  - telegram_chat: -1009876543210
+//	    irc_server: irc.libera.chat:6667
+//	    irc_channel: "#hackerspace-pl-offtopic"
+//	    nick_suffix: "[o]"
+//	    irc_max_connections: 5
+//
+// Any setting not given for a bridge defaults to the value of its flag, except
+// for message_store and spool_dir, which default to paths derived from their
+// flags and the chat ID (eg. <message_store>.-1001234567890 and
+// <spool_dir>/-1001234567890), as bridges cannot share them. Bridges on the
+// same IRC network (server, irc_login, nick_prefix and nick_suffix) share IRC
+// connections, so they must bridge different IRC channels and agree on
+// irc_max_connections.
+//
+// Settings without a bridgeConfig field, like IRC TLS and SASL, flood control,
+// presence and topic relaying, media serving and the Telegram webhook, are
+// only given by flags and apply to all bridges.
+type config struct {
+	Bridges []*bridgeConfig `yaml:"bridges"`
+}
+
+// bridgeConfig is the configuration of a single bridge between a Telegram
+// group and an IRC channel.
+type bridgeConfig struct {
+	// Telegram chat/group ID to bridge. Zero means lame mode.
+	TelegramChat int64 `yaml:"telegram_chat"`
+	// Address (with port) of the IRC server.
+	IRCServer string `yaml:"irc_server"`
+	// IRC channel name (including hash(es)).
+	IRCChannel string `yaml:"irc_channel"`
+	// Login of the backup IRC connection.
+	IRCLogin string `yaml:"irc_login"`
+	// Maximum number of IRC connections.
+	IRCMaxConnections int `yaml:"irc_max_connections"`
+	// Prefix and suffix of IRC nicks.
+	NickPrefix string `yaml:"nick_prefix"`
+	NickSuffix string `yaml:"nick_suffix"`
+	// Root URL of media served to IRC.
+	TeleimgRoot string `yaml:"teleimg_root"`
+	// Path of the message store.
+	MessageStore string `yaml:"message_store"`
+	// Path of the directory keeping spooled messages.
+	SpoolDir string `yaml:"spool_dir"`
+	// Send messages to IRC without formatting codes.
+	IRCPlain *bool `yaml:"irc_plain"`
+	// Render inline markup typed by IRC users on Telegram.
+	IRCMarkup *bool `yaml:"irc_markup"`
+	// Upload media linked on IRC to Telegram.
+	IRCUpload *bool `yaml:"irc_upload"`
+}
+
+// bridgeFromFlags returns the configuration of a single bridge given by flags.
+func bridgeFromFlags() (*bridgeConfig, error) {
+	// Parse given group ID.
+	// If not set, start server in 'lame' mode, ie. one that will not actually
+	// perform any bridging, but will let you figure out the IDs of groups that
+	// this bot is part of.
+	var groupId int64
+	if flagTelegramChat == "" {
+		glog.Warningf("telegram_chat NOT GIVEN, STARTING IN LAME MODE")
+		glog.Warningf("Watch for logs to find out the ID of groups which this bot is part of. Then, restart the bot with telegram_chat set.")
+	} else {
+		g, err := strconv.ParseInt(flagTelegramChat, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("telegram_chat must be a number")
+		}
+		groupId = g
+	}
+
+	b := &bridgeConfig{
+		TelegramChat: groupId,
+		MessageStore: flagMessageStore,
+		SpoolDir:     flagSpoolDir,
+	}
+	if err := b.setDefaults(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// loadConfig reads the bridges configured in a configuration file.
+func loadConfig(path string) ([]*bridgeConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", path, err)
+	}
+	if len(c.Bridges) == 0 {
+		return nil, fmt.Errorf("no bridges configured in %q", path)
+	}
+
+	chats := make(map[int64]bool)
+	stores := make(map[string]bool)
+	spools := make(map[string]bool)
+	for i, b := range c.Bridges {
+		if b.TelegramChat == 0 {
+			return nil, fmt.Errorf("bridge %d: telegram_chat must be set", i)
+		}
+		if chats[b.TelegramChat] {
+			return nil, fmt.Errorf("bridge %d: telegram_chat %d bridged more than once", i, b.TelegramChat)
+		}
+		chats[b.TelegramChat] = true
+		if b.MessageStore == "" && flagMessageStore != "" {
+			b.MessageStore = fmt.Sprintf("%s.%d", flagMessageStore, b.TelegramChat)
+		}
+		if b.SpoolDir == "" && flagSpoolDir != "" {
+			b.SpoolDir = filepath.Join(flagSpoolDir, strconv.FormatInt(b.TelegramChat, 10))
+		}
+		if b.MessageStore != "" {
+			p := filepath.Clean(b.MessageStore)
+			if stores[p] {
+				return nil, fmt.Errorf("bridge %d: message_store %q used by more than one bridge", i, b.MessageStore)
+			}
+			stores[p] = true
+		}
+		if b.SpoolDir != "" {
+			p := filepath.Clean(b.SpoolDir)
+			if spools[p] {
+				return nil, fmt.Errorf("bridge %d: spool_dir %q used by more than one bridge", i, b.SpoolDir)
+			}
+			spools[p] = true
+		}
+		if err := b.setDefaults(); err != nil {
+			return nil, fmt.Errorf("bridge %d: %v", i, err)
+		}
+	}
+	for _, n := range networks(c.Bridges) {
+		channels := make(map[string]bool)
+		for _, b := range n {
+			if channels[b.IRCChannel] {
+				return nil, fmt.Errorf("irc_channel %s on %s bridged more than once", b.IRCChannel, b.IRCServer)
+			}
+			channels[b.IRCChannel] = true
+			if b.IRCMaxConnections != n[0].IRCMaxConnections {
+				return nil, fmt.Errorf("irc_channel %s and %s on %s share IRC connections, but have different irc_max_connections (%d and %d)", n[0].IRCChannel, b.IRCChannel, b.IRCServer, n[0].IRCMaxConnections, b.IRCMaxConnections)
+			}
+		}
+	}
+	return c.Bridges, nil
+}
+
+// setDefaults fills in unset settings from flags, and validates the
+// configuration.
+func (b *bridgeConfig) setDefaults() error {
+	if b.IRCServer == "" {
+		b.IRCServer = flagIRCServer
+	}
+	if b.IRCChannel == "" {
+		b.IRCChannel = flagIRCChannel
+	}
+	if b.IRCChannel == "" {
+		return fmt.Errorf("irc_channel must be set")
+	}
+	// https://tools.ietf.org/html/rfc2812#section-1.3 "Channel names are case insensitive"
+	b.IRCChannel = strings.ToLower(b.IRCChannel)
+	if b.IRCLogin == "" {
+		b.IRCLogin = flagIRCLogin
+	}
+	if b.IRCLogin == "" {
+		b.IRCLogin = "lelegram"
+	}
+	if b.IRCMaxConnections == 0 {
+		b.IRCMaxConnections = flagIRCMaxConnections
+	}
+	if b.NickPrefix == "" && b.NickSuffix == "" {
+		b.NickPrefix = flagNickPrefix
+		b.NickSuffix = flagNickSuffix
+	}
+	if b.NickPrefix == "" && b.NickSuffix == "" {
+		glog.Warning("No prefix nor suffix for nicks has been choosen. Default nick will have [t] suffix")
+		b.NickSuffix = "[t]"
+	}
+	if b.TeleimgRoot == "" {
+		b.TeleimgRoot = flagTeleimgRoot
+	}
+	// Options are pointers so that ones set to false in a configuration
+	// file are told apart from unset ones.
+	if b.IRCPlain == nil {
+		v := flagIRCPlain
+		b.IRCPlain = &v
+	}
+	if b.IRCMarkup == nil {
+		v := flagIRCMarkup
+		b.IRCMarkup = &v
+	}
+	if b.IRCUpload == nil {
+		v := flagIRCUpload
+		b.IRCUpload = &v
+	}
+	return nil
+}
+
+// networks groups bridges by the IRC network they are on, ie. bridges that
+// can share IRC connections. Groups are returned in order of appearance.
+func networks(bridges []*bridgeConfig) [][]*bridgeConfig {
+	res := [][]*bridgeConfig{}
+	for _, b := range bridges {
+		found := false
+		for i, n := range res {
+			o := n[0]
+			if o.IRCServer == b.IRCServer && o.IRCLogin == b.IRCLogin && o.NickPrefix == b.NickPrefix && o.NickSuffix == b.NickSuffix {
+				res[i] = append(n, b)
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, []*bridgeConfig{b})
+		}
+	}
+	return res
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfig writes a configuration file, returning its path.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "lelelegram")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigPaths(t *testing.T) {
+	defer func(store, spool string) { flagMessageStore, flagSpoolDir = store, spool }(flagMessageStore, flagSpoolDir)
+	flagMessageStore, flagSpoolDir = "/var/lib/lele/messages", "/var/lib/lele/spool"
+
+	// Bridges get their own paths derived from the flags.
+	bridges, err := loadConfig(writeConfig(t, `
+bridges:
+  - telegram_chat: -1
+    irc_channel: "#a"
+  - telegram_chat: -2
+    irc_channel: "#b"
+    message_store: /tmp/b.messages
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	for i, want := range []struct{ store, spool string }{
+		{"/var/lib/lele/messages.-1", "/var/lib/lele/spool/-1"},
+		{"/tmp/b.messages", "/var/lib/lele/spool/-2"},
+	} {
+		if b := bridges[i]; b.MessageStore != want.store || b.SpoolDir != want.spool {
+			t.Errorf("bridge %d: got %q, %q, want %q, %q", i, b.MessageStore, b.SpoolDir, want.store, want.spool)
+		}
+	}
+
+	// But can't share them.
+	for _, dup := range []string{"message_store: /tmp/messages", "spool_dir: /tmp/spool"} {
+		_, err := loadConfig(writeConfig(t, `
+bridges:
+  - telegram_chat: -1
+    irc_channel: "#a"
+    `+dup+`
+  - telegram_chat: -2
+    irc_channel: "#b"
+    `+dup+`
+`))
+		if err == nil {
+			t.Errorf("bridges sharing %s accepted", dup)
+		}
+	}
+}
+
+func TestLoadConfigOptions(t *testing.T) {
+	defer func(plain, markup bool) { flagIRCPlain, flagIRCMarkup = plain, markup }(flagIRCPlain, flagIRCMarkup)
+	flagIRCPlain, flagIRCMarkup = true, true
+
+	// Options set to false override their flags, unset ones default to them.
+	bridges, err := loadConfig(writeConfig(t, `
+bridges:
+  - telegram_chat: -1
+    irc_channel: "#a"
+    irc_plain: false
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if b := bridges[0]; *b.IRCPlain || !*b.IRCMarkup {
+		t.Errorf("got irc_plain %v, irc_markup %v, want false, true", *b.IRCPlain, *b.IRCMarkup)
+	}
+}
+
+func TestLoadConfigNetworks(t *testing.T) {
+	for _, c := range []struct {
+		name, second string
+		ok           bool
+	}{
+		{"other channel", `irc_channel: "#b"`, true},
+		{"same channel", `irc_channel: "#A"`, false},
+		{"same channel on other network", `irc_channel: "#a"
+    nick_suffix: "[o]"`, true},
+		{"other max_connections", `irc_channel: "#b"
+    irc_max_connections: 3`, false},
+	} {
+		_, err := loadConfig(writeConfig(t, `
+bridges:
+  - telegram_chat: -1
+    irc_channel: "#a"
+  - telegram_chat: -2
+    `+c.second+`
+`))
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("%s: got error %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Policies of relaying Telegram message edits to IRC.
+const (
+	// editsOff drops edits.
+	editsOff = "off"
+	// editsDiff sends a s/old/new/ correction line, if the change is small
+	// enough, or the full text otherwise.
+	editsDiff = "diff"
+	// editsFull sends the full new text, marked as edited.
+	editsFull = "full"
+)
+
+// editCorrection returns a s/old/new/ style correction turning before into
+// after, changing whole words only. An empty string is returned if there is no
+// change, or the change cannot be expressed as a short correction.
+func editCorrection(before, after string) string {
+	b := strings.Fields(before)
+	a := strings.Fields(after)
+
+	// Find common prefix and suffix words.
+	pre := 0
+	for pre < len(b) && pre < len(a) && b[pre] == a[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(b)-pre && suf < len(a)-pre && b[len(b)-1-suf] == a[len(a)-1-suf] {
+		suf++
+	}
+	old := strings.Join(b[pre:len(b)-suf], " ")
+	new := strings.Join(a[pre:len(a)-suf], " ")
+
+	switch {
+	case old == "" && new == "":
+		// Only whitespace changed.
+		return ""
+	case old == "":
+		// Pure insertion, anchor it on a neighbouring word.
+		if pre > 0 {
+			old = b[pre-1]
+			new = b[pre-1] + " " + new
+		} else if suf > 0 {
+			old = b[len(b)-suf]
+			new = new + " " + b[len(b)-suf]
+		} else {
+			return ""
+		}
+	}
+	if strings.Contains(old, "/") || strings.Contains(new, "/") {
+		return ""
+	}
+	// Corrections longer than half the message are not much of a correction.
+	if len(old)+len(new) > len(after)/2+16 {
+		return ""
+	}
+	return fmt.Sprintf("s/%s/%s/", old, new)
+}
+
+// correctionLookback is how many of the last messages of an IRC user are
+// considered when applying a s/old/new/ correction from IRC.
+const correctionLookback = 5
+
+var reCorrection = regexp.MustCompile(`^s/((?:[^/\\]|\\.)+)/((?:[^/\\]|\\.)*)(?:/(g?))?$`)
+
+// correction is a parsed s/old/new/ correction line.
+type correction struct {
+	old    string
+	new    string
+	global bool
+}
+
+// parseCorrection parses a s/old/new/ (or s/old/new/g) line as commonly sent
+// on IRC to correct a previous message. Patterns are taken literally, with
+// '\/' standing for a slash. nil is returned if line is not a correction.
+func parseCorrection(line string) *correction {
+	m := reCorrection.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return nil
+	}
+	unescape := strings.NewReplacer(`\/`, "/", `\\`, `\`).Replace
+	return &correction{
+		old:    unescape(m[1]),
+		new:    unescape(m[2]),
+		global: m[3] == "g",
+	}
+}
+
+// apply returns text with the correction applied, and whether it changed
+// anything.
+func (c *correction) apply(text string) (string, bool) {
+	if !strings.Contains(text, c.old) {
+		return text, false
+	}
+	n := 1
+	if c.global {
+		n = -1
+	}
+	return strings.Replace(text, c.old, c.new, n), true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// mIRC formatting control codes.
+const (
+	ircBold          = "\x02"
+	ircItalic        = "\x1d"
+	ircUnderline     = "\x1f"
+	ircStrikethrough = "\x1e"
+	ircMonospace     = "\x11"
+	ircReset         = "\x0f"
+	// ircSpoiler is black on black, the IRC convention for spoilers.
+	ircSpoiler = "\x0301,01"
+)
+
+// ircFromEntities renders the formatting entities of a Telegram message text
+// into mIRC formatting codes. The URLs of text links are inlined after the
+// link text, and spoilers are masked. If plain is set, no formatting codes are
+// used, and spoilers are replaced by a placeholder.
+func ircFromEntities(text string, entities []tgbotapi.MessageEntity, plain bool) string {
+	if len(entities) == 0 {
+		return text
+	}
+
+	// Entity offsets and lengths are in UTF-16 code units.
+	u := utf16.Encode([]rune(text))
+	clamp := func(i int) int {
+		if i < 0 {
+			return 0
+		}
+		if i > len(u) {
+			return len(u)
+		}
+		return i
+	}
+	// Split the text into segments at every entity boundary.
+	bounds := map[int]bool{0: true, len(u): true}
+	for _, e := range entities {
+		bounds[clamp(e.Offset)] = true
+		bounds[clamp(e.Offset+e.Length)] = true
+	}
+	points := []int{}
+	for p := range bounds {
+		points = append(points, p)
+	}
+	sort.Ints(points)
+
+	var b strings.Builder
+	// formatting codes in effect
+	active := ""
+	for k := 0; k+1 < len(points); k++ {
+		from, to := points[k], points[k+1]
+
+		// Find out the formatting of this segment.
+		var bold, italic, underline, strike, mono, spoiler, spoilerStart bool
+		for _, e := range entities {
+			if clamp(e.Offset) > from || clamp(e.Offset+e.Length) < to {
+				continue
+			}
+			switch e.Type {
+			case "bold":
+				bold = true
+			case "italic":
+				italic = true
+			case "underline":
+				underline = true
+			case "strikethrough":
+				strike = true
+			case "code", "pre":
+				mono = true
+			case "spoiler":
+				spoiler = true
+				if clamp(e.Offset) == from {
+					spoilerStart = true
+				}
+			}
+		}
+
+		if plain && spoiler {
+			if spoilerStart {
+				b.WriteString("[spoiler]")
+			}
+			continue
+		}
+
+		codes := ""
+		if !plain {
+			for _, c := range []struct {
+				on   bool
+				code string
+			}{
+				{bold, ircBold},
+				{italic, ircItalic},
+				{underline, ircUnderline},
+				{strike, ircStrikethrough},
+				{mono, ircMonospace},
+				{spoiler, ircSpoiler},
+			} {
+				if c.on {
+					codes += c.code
+				}
+			}
+		}
+		if codes != active {
+			if active != "" {
+				b.WriteString(ircReset)
+			}
+			b.WriteString(codes)
+			active = codes
+		}
+		seg := string(utf16.Decode(u[from:to]))
+		if active != "" {
+			// Clients reset formatting at the end of a line.
+			seg = strings.ReplaceAll(seg, "\n", ircReset+"\n"+active)
+		}
+		b.WriteString(seg)
+
+		// Inline URLs of text links ending here.
+		for _, e := range entities {
+			if e.Type != "text_link" || clamp(e.Offset+e.Length) != to || e.URL == "" {
+				continue
+			}
+			if string(utf16.Decode(u[clamp(e.Offset):to])) == e.URL {
+				continue
+			}
+			b.WriteString(" (" + e.URL + ")")
+		}
+	}
+	if active != "" {
+		b.WriteString(ircReset)
+	}
+	return b.String()
+}
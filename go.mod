@@ -7,7 +7,9 @@ require (
 	github.com/go-telegram-bot-api/telegram-bot-api v4.6.4+incompatible
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/kr/pretty v0.1.0 // indirect
+	github.com/rivo/uniseg v0.2.0
 	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/irc.v3 v3.1.3
+	gopkg.in/yaml.v2 v2.4.0
 )
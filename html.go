@@ -0,0 +1,97 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/hakierspejs/lelelegram/irc"
+)
+
+// escapeHTML escapes text for Telegram messages with the HTML parse mode.
+var escapeHTML = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+// htmlFromIRC renders IRC text with mIRC formatting codes into Telegram HTML.
+// Formatting without a Telegram equivalent (eg. colours) is dropped.
+func htmlFromIRC(text string) string {
+	var b strings.Builder
+	for _, s := range irc.ParseFormatting(text) {
+		t := escapeHTML(s.Text)
+		if s.Monospace {
+			// Telegram does not allow formatting inside code.
+			b.WriteString("<code>" + t + "</code>")
+			continue
+		}
+		tags := []string{}
+		if s.Bold {
+			tags = append(tags, "b")
+		}
+		if s.Italic {
+			tags = append(tags, "i")
+		}
+		if s.Underline {
+			tags = append(tags, "u")
+		}
+		if s.Strikethrough {
+			tags = append(tags, "s")
+		}
+		for _, tag := range tags {
+			b.WriteString("<" + tag + ">")
+		}
+		b.WriteString(t)
+		for i := len(tags) - 1; i >= 0; i-- {
+			b.WriteString("</" + tags[i] + ">")
+		}
+	}
+	return b.String()
+}
+
+// ircMarkup are the kinds of inline markup commonly typed on IRC, and the
+// mIRC formatting codes they stand for. Markup must be delimited by whitespace
+// or punctuation, so that eg. snake_case_names are left alone.
+var ircMarkup = []struct {
+	re   *regexp.Regexp
+	code string
+}{
+	{regexp.MustCompile(`(^|[\s(])\*([^\s*](?:[^*]*[^\s*])?)\*($|[\s.,!?;:)])`), "\x02"},
+	{regexp.MustCompile(`(^|[\s(])_([^\s_](?:[^_]*[^\s_])?)_($|[\s.,!?;:)])`), "\x1d"},
+	{regexp.MustCompile(`(^|[\s(])~([^\s~](?:[^~]*[^\s~])?)~($|[\s.,!?;:)])`), "\x1e"},
+}
+
+// ircCodeMarkup is `code` markup, whose contents are left as they are.
+var ircCodeMarkup = regexp.MustCompile("(^|[\\s(])`([^`]+)`($|[\\s.,!?;:)])")
+
+// ircFromMarkup turns inline markup typed by IRC users (eg. *bold*) into mIRC
+// formatting codes.
+func ircFromMarkup(text string) string {
+	// Code spans are cut out one by one, so that other markup is not applied
+	// to them, rather than marked, as any marker could already be in the text.
+	// They are set off by resets, so that formatting codes typed around (or
+	// in) them can't leak into or out of them.
+	res := ""
+	for {
+		loc := ircCodeMarkup.FindStringSubmatchIndex(text)
+		if loc == nil {
+			break
+		}
+		// Contents of the span are at loc[4]:loc[5], between backticks.
+		// The rest of the text starts after the closing backtick, so that
+		// what follows it can start the next span.
+		code := irc.StripFormatting(text[loc[4]:loc[5]])
+		res += ircFromInlineMarkup(text[:loc[4]-1]) + "\x0f\x11" + code + "\x0f"
+		text = text[loc[5]+1:]
+	}
+	return res + ircFromInlineMarkup(text)
+}
+
+// ircFromInlineMarkup turns inline markup other than code spans into mIRC
+// formatting codes.
+func ircFromInlineMarkup(text string) string {
+	for _, m := range ircMarkup {
+		// Matches consume their delimiters, so adjacent markup needs a
+		// second pass.
+		for i := 0; i < 2; i++ {
+			text = m.re.ReplaceAllString(text, "${1}"+m.code+"${2}"+m.code+"${3}")
+		}
+	}
+	return text
+}
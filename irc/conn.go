@@ -2,9 +2,10 @@ package irc
 
 import (
 	"context"
+	"crypto/tls"
+	"expvar"
 	"fmt"
 	"net"
-	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,24 +19,34 @@ import (
 type ircconn struct {
 	// server to connect to
 	server string
-	// channel to join
-	channel string
+	// channels to join right after connecting
+	channels []string
 	// 'native' name of this connection.
 	user string
 
+	// SASL credentials to authenticate with, or nil
+	sasl *SASLCredentials
+
 	// Event Handler, usually a Manager
 	eventHandler func(e *event)
+	// events waiting to be passed to eventHandler, oldest first, guarded by
+	// emu. ev is signalled when events are added.
+	events []*event
+	emu    sync.Mutex
+	ev     chan struct{}
 
-	// TCP connection to IRC
+	// TCP (or TLS) connection to IRC
 	conn net.Conn
-	// IRC client
-	irc *irc.Client
+	// IRC protocol reader/writer over conn
+	irc *irc.Conn
+	// nicks to try in order, the first one being the preferred one
+	nicks []string
 
 	/// Fields used by the manager - do not access from ircconn.
 	// last time this connection was used
 	last time.Time
-	// is primary source of IRC data
-	receiver bool
+	// set of channels for which this is the primary source of IRC data
+	receiver map[string]bool
 	// only exists to be a receiver
 	backup bool
 	// iq is the IRC Queue of IRC messages, populated by the IRC client and
@@ -47,17 +58,32 @@ type ircconn struct {
 	// eq is the Evict Queue, used by the manager to signal that a connection
 	// should die.
 	eq chan struct{}
+	// xq is the eXit Queue, used by Run to signal to the connection that the
+	// IRC client exited with a given error.
+	xq chan error
 	// ds is the Dead Signal, a channel closed by the connection when it will
 	// not service any more requests through sq.
 	ds chan struct{}
+	// err is the reason the connection died, set before ds is closed.
+	err error
+
+	// flood control of lines sent by this connection, and by all connections
+	// to the server
+	limit  *tokenBucket
+	global *tokenBucket
+	// number of lines waiting for flood control, exported as a metric
+	depth *expvar.Int
 
 	// connected is a flag (via sync/atomic) that is used to signal to the
 	// manager that this connection is up and healthy.
 	connected int64
+	// joined is the set of channels that this connection has joined, used to
+	// signal to the manager which channels the connection can receive from
+	// and send to. Guarded by mu.
+	joined map[string]bool
+	mu     sync.Mutex
 }
 
-var reIRCNick = regexp.MustCompile(`[^A-Za-z0-9]`)
-
 // Say is called by the Manager when a message should be sent out by the
 // connection.
 func (i *ircconn) Say(msg *controlMessage) {
@@ -65,12 +91,11 @@ func (i *ircconn) Say(msg *controlMessage) {
 	case i.sq <- msg:
 		// message got routed - nothing to do.
 	case <-i.ds:
+		// message dropped, let the caller know why.
+		glog.Errorf("Message dropped due to aborted connection: %v", msg)
 		go func() {
-			msg.done <- nil
+			msg.done <- i.err
 		}()
-		// message dropped.
-		// TODO(q3k): return error to caller instead of silently dropping.
-		glog.Errorf("Message dropped due to aborted connection: %v", msg)
 	}
 }
 
@@ -79,6 +104,15 @@ func (i *ircconn) Evict() {
 	close(i.eq)
 }
 
+// outLine is a line of a message waiting for flood control.
+type outLine struct {
+	m *irc.Message
+	// message the line is part of
+	s *controlMessage
+	// whether this is the last line of the message
+	last bool
+}
+
 // ircMessage is a message received on IRC by a connection, sent over to the
 // Manager.
 type IRCMessage struct {
@@ -87,71 +121,74 @@ type IRCMessage struct {
 	text string
 }
 
-func NewConn(server, channel, userTelegram string, backup bool, nickPrefix string, nickSuffix string,
-	h func(e *event)) (*ircconn, error) {
+// NewConn dials IRC as a given Telegram user, and will join the given channels
+// once connected. More channels are joined as messages are sent to them. If
+// tlsConfig is not nil, the connection is wrapped in TLS. The TLS handshake
+// (and thus certificate verification) happens when the connection is Run, and
+// failures are reported as the connection dying. If sasl is not nil, the
+// connection will authenticate using SASL before joining any channel. Lines
+// sent to channels are subject to flood control by limit, and by global which
+// is shared by all connections to the server.
+func NewConn(server string, channels []string, userTelegram string, backup bool, nickPrefix string, nickSuffix string,
+	tlsConfig *tls.Config, sasl *SASLCredentials, limit RateLimit, global *tokenBucket, h func(e *event)) (*ircconn, error) {
 	// Generate IRC nick from username.
-	// RFC standard - 9. Freenode allows 16 chars for nickname
-	const maxIRCNick = 16
-	nick := reIRCNick.ReplaceAllString(userTelegram, "")
-	username := nick
-	var nickLen = maxIRCNick - len(nickPrefix) - len(nickSuffix)
-	if len(username) > 9 {
-		username = username[:9]
-	}
-	nick = strings.ToLower(nick)
-	if len(nick) > nickLen {
-		nick = nick[:nickLen]
-	}
-	if len(nick) == 0 {
-		glog.Errorf("Could not create IRC nick for %q", userTelegram)
-		nick = "wtf"
-	}
-	// Add prefix and suffix at the end
-	nick = nickPrefix + nick + nickSuffix
+	nicks := ircNicks(userTelegram, nickPrefix, nickSuffix)
+	nick := nicks[0]
+	username := ircUsername(userTelegram)
 
-	glog.Infof("Connecting to IRC/%s/%s/%s as %s from %s...", server, channel, userTelegram, nick, username)
+	glog.Infof("Connecting to IRC/%s/%s/%s as %s from %s...", server, strings.Join(channels, ","), userTelegram, nick, username)
 	conn, err := net.Dial("tcp", server)
 	if err != nil {
 		return nil, fmt.Errorf("Dial(_, %q): %v", server, err)
 	}
+	if tlsConfig != nil {
+		conn = tls.Client(conn, tlsConfig)
+	}
 
 	i := &ircconn{
-		server:  server,
-		channel: channel,
-		user:    userTelegram,
+		server:   server,
+		channels: channels,
+		user:     userTelegram,
+
+		sasl: sasl,
 
 		eventHandler: h,
 
-		conn: conn,
-		irc:  nil,
+		conn:  conn,
+		irc:   irc.NewConn(conn),
+		nicks: nicks,
 
 		last:     time.Now(),
 		backup:   backup,
-		receiver: backup,
+		receiver: make(map[string]bool),
 
 		iq: make(chan *irc.Message),
 		sq: make(chan *controlMessage),
 		eq: make(chan struct{}),
+		xq: make(chan error, 1),
 		ds: make(chan struct{}),
+		ev: make(chan struct{}, 1),
+
+		limit:  newTokenBucket(limit),
+		global: global,
+		depth:  new(expvar.Int),
 
 		connected: int64(0),
+		joined:    make(map[string]bool),
 	}
-
-	// Configure IRC client to populate the IRC Queue.
-	config := irc.ClientConfig{
-		Nick: nick,
-		User: username,
-		Name: userTelegram,
-		Handler: irc.HandlerFunc(func(c *irc.Client, m *irc.Message) {
-			i.iq <- m
-		}),
+	if backup {
+		for _, c := range channels {
+			i.receiver[c] = true
+		}
 	}
 
-	i.irc = irc.NewClient(conn, config)
+	metricQueueDepth.Set(i.metricKey(), i.depth)
 	return i, nil
 }
 
 func (i *ircconn) Run(ctx context.Context) {
+	go i.forward(ctx)
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -161,13 +198,21 @@ func (i *ircconn) Run(ctx context.Context) {
 	}()
 
 	go func() {
-		err := i.irc.RunContext(ctx)
+		if err := i.handshake(); err != nil {
+			glog.Errorf("IRC/%s/%s TLS handshake failed: %v", i.server, i.user, err)
+			i.xq <- fmt.Errorf("TLS handshake: %v", err)
+			wg.Wait()
+			return
+		}
+		// Request capabilities before registering, so that the server holds
+		// off registration until we send CAP END.
+		for _, c := range i.caps() {
+			i.irc.Write("CAP REQ :" + c)
+		}
+		err := i.run(ctx)
 		if err != ctx.Err() {
-			glog.Errorf("IRC/%s/%s/%s exited: %v", i.server, i.channel, i.user, err)
-			i.conn.Close()
-			i.eventHandler(&event{
-				dead: &eventDead{i},
-			})
+			glog.Errorf("IRC/%s/%s exited: %v", i.server, i.user, err)
+			i.xq <- err
 		}
 		wg.Wait()
 	}()
@@ -175,22 +220,312 @@ func (i *ircconn) Run(ctx context.Context) {
 	wg.Wait()
 }
 
+// run registers with IRC using the preferred nick, and then passes messages
+// read from IRC to the IRC Queue until the connection fails or ctx is done.
+// Nick collisions while registering are handled by loop, which tries the
+// alternative nicks in order.
+func (i *ircconn) run(ctx context.Context) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		i.conn.Close()
+	}()
+
+	if err := i.irc.Writef("NICK :%s", i.nicks[0]); err != nil {
+		return err
+	}
+	if err := i.irc.Writef("USER %s 0 * :%s", ircUsername(i.user), i.user); err != nil {
+		return err
+	}
+	for {
+		m, err := i.irc.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if m.Command == "PING" {
+			reply := m.Copy()
+			reply.Command = "PONG"
+			i.irc.WriteMessage(reply)
+		}
+		select {
+		case i.iq <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// handshake performs the TLS handshake on the connection, if it is a TLS
+// connection. This makes certificate verification errors explicit instead of
+// having them surface as a generic write error from the IRC client.
+func (i *ircconn) handshake() error {
+	tc, ok := i.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tc.SetDeadline(time.Now().Add(30 * time.Second))
+	defer tc.SetDeadline(time.Time{})
+	return tc.Handshake()
+}
+
+// ctcpAction encodes text as a CTCP ACTION (/me).
+func ctcpAction(text string) string {
+	return "\x01ACTION " + text + "\x01"
+}
+
+// parseCTCPAction decodes a CTCP ACTION (/me), returning the action text and
+// true. Other messages are returned as is.
+func parseCTCPAction(text string) (string, bool) {
+	if !strings.HasPrefix(text, "\x01ACTION ") {
+		return text, false
+	}
+	text = strings.TrimPrefix(text, "\x01ACTION ")
+	// The closing delimiter is sometimes omitted by clients.
+	return strings.TrimSuffix(text, "\x01"), true
+}
+
+// presence turns an IRC message into presence events on the joined channels
+// it concerns, given the nicks present on each channel. The nicks are updated
+// accordingly.
+func (i *ircconn) presence(m *irc.Message, joined map[string]bool, names map[string]map[string]bool) []*eventPresence {
+	nick := m.Prefix.Name
+	mk := func(channel string, kind PresenceKind) *eventPresence {
+		return &eventPresence{
+			conn:    i,
+			channel: channel,
+			kind:    kind,
+			nick:    nick,
+		}
+	}
+	// channel returns the lowercased channel of the message if it is joined.
+	channel := func() string {
+		if len(m.Params) < 1 {
+			return ""
+		}
+		c := strings.ToLower(m.Params[0])
+		if !joined[c] {
+			return ""
+		}
+		return c
+	}
+
+	res := []*eventPresence{}
+	switch m.Command {
+	case "JOIN":
+		c := channel()
+		if c == "" {
+			return nil
+		}
+		names[c][nick] = true
+		res = append(res, mk(c, PresenceJoin))
+	case "PART":
+		c := channel()
+		if c == "" {
+			return nil
+		}
+		delete(names[c], nick)
+		p := mk(c, PresencePart)
+		if len(m.Params) > 1 {
+			p.reason = m.Params[1]
+		}
+		res = append(res, p)
+	case "KICK":
+		c := channel()
+		if c == "" || len(m.Params) < 2 {
+			return nil
+		}
+		delete(names[c], m.Params[1])
+		p := mk(c, PresenceKick)
+		p.target = m.Params[1]
+		if len(m.Params) > 2 {
+			p.reason = m.Params[2]
+		}
+		res = append(res, p)
+	case "QUIT":
+		for c, n := range names {
+			if !n[nick] {
+				continue
+			}
+			delete(n, nick)
+			p := mk(c, PresenceQuit)
+			if len(m.Params) > 0 {
+				p.reason = m.Params[0]
+			}
+			res = append(res, p)
+		}
+	case "NICK":
+		if len(m.Params) < 1 {
+			return nil
+		}
+		for c, n := range names {
+			if !n[nick] {
+				continue
+			}
+			delete(n, nick)
+			n[m.Params[0]] = true
+			p := mk(c, PresenceNick)
+			p.target = m.Params[0]
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// caps returns the IRCv3 capabilities requested by the connection.
+func (i *ircconn) caps() []string {
+	caps := []string{"message-tags"}
+	if i.sasl != nil {
+		caps = append(caps, "sasl")
+	}
+	return caps
+}
+
+// emit queues an event for the event handler. Events are passed on in order
+// by forward, without blocking the connection: the Manager may itself be
+// blocked on handing a message to the connection.
+func (i *ircconn) emit(e *event) {
+	i.emu.Lock()
+	i.events = append(i.events, e)
+	i.emu.Unlock()
+	select {
+	case i.ev <- struct{}{}:
+	default:
+	}
+}
+
+// forward passes emitted events to the event handler in order, until the
+// connection is dead or ctx is done.
+func (i *ircconn) forward(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-i.ev:
+		}
+		i.emu.Lock()
+		events := i.events
+		i.events = nil
+		i.emu.Unlock()
+		for _, e := range events {
+			i.eventHandler(e)
+			if e.dead != nil {
+				return
+			}
+		}
+	}
+}
+
+// saslFailed notifies the Manager about a failed SASL authentication and kills
+// the connection.
+func (i *ircconn) saslFailed(die func(error), reason string) {
+	i.emit(&event{
+		saslFailed: &eventSASLFailed{i, reason},
+	})
+	die(fmt.Errorf("%w: %s", ErrAuthFailed, reason))
+}
+
 // IsConnected returns whether a connection is fully alive and able to receive
-// messages.
+// messages, ie. has joined at least one channel.
 func (i *ircconn) IsConnected() bool {
 	return atomic.LoadInt64(&i.connected) > 0
 }
 
+// metricKey is the key of this connection in per-connection metrics.
+func (i *ircconn) metricKey() string {
+	return i.server + "/" + i.user
+}
+
+// IsDead returns whether a connection has died and will not send any more
+// messages.
+func (i *ircconn) IsDead() bool {
+	select {
+	case <-i.ds:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsJoined returns whether a connection has joined a given channel and is
+// able to receive messages from it.
+func (i *ircconn) IsJoined(channel string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.joined[channel]
+}
+
+// setJoined marks a channel as joined or not.
+func (i *ircconn) setJoined(channel string, joined bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if joined {
+		i.joined[channel] = true
+	} else {
+		delete(i.joined, channel)
+	}
+	if len(i.joined) > 0 {
+		atomic.StoreInt64(&i.connected, 1)
+	} else {
+		atomic.StoreInt64(&i.connected, 0)
+	}
+}
+
+// stripNamePrefix removes channel membership prefixes (eg. @ for ops) from a
+// nick as returned in RPL_NAMREPLY.
+func stripNamePrefix(nick string) string {
+	return strings.TrimLeft(nick, "~&@%+")
+}
+
 // loop is the main loop of an IRC connection.
 // It synchronizes the Handler Queue, Say Queue and Evict Queue, parses
 func (i *ircconn) loop(ctx context.Context) {
 	sayqueue := []*controlMessage{}
-	connected := false
 	dead := false
-
+	// whether the server accepted the message-tags capability
+	tags := false
+	// channels joined, channels being joined (and since when), and nicks
+	// present on joined channels
+	joined := make(map[string]bool)
+	joining := make(map[string]time.Time)
+	names := make(map[string]map[string]bool)
+	// when the connection was started
+	start := time.Now()
+	// lines waiting for flood control, and a timer that fires when the next
+	// one can be sent
+	outq := []*outLine{}
+	var floodC <-chan time.Time
+	// our user@host as seen by others, assumed to be as long as possible
+	// until we see it
+	userhost := "~" + ircUsername(i.user) + "@" + strings.Repeat("x", maxHost)
+	// our nick, as requested while registering and then as confirmed by the
+	// server.
+	nick := i.nicks[0]
+
+	// die kills the connection, failing all queued messages with err, which
+	// must be (or wrap) one of ErrConnectionDead, ErrEvicted, ErrBanned,
+	// ErrTimeout, ErrNoNick or ErrAuthFailed.
 	die := func(err error) {
 		// drain queue of say messages...
+		i.err = err
 		close(i.ds)
+		for _, l := range outq {
+			if l.last {
+				glog.Infof("IRC/%s/say: [drop] %q", i.user, l.s.message)
+				l.s.done <- err
+			}
+		}
+		outq = []*outLine{}
+		i.depth.Set(0)
+		if metricQueueDepth.Get(i.metricKey()) == i.depth {
+			metricQueueDepth.Delete(i.metricKey())
+		}
 		for _, s := range sayqueue {
 			glog.Infof("IRC/%s/say: [drop] %q", i.user, s.message)
 			s.done <- err
@@ -198,47 +533,174 @@ func (i *ircconn) loop(ctx context.Context) {
 		sayqueue = []*controlMessage{}
 		dead = true
 		i.conn.Close()
-		go i.eventHandler(&event{
+		i.emit(&event{
 			dead: &eventDead{i},
 		})
 	}
-	msg := func(s *controlMessage) {
-		lines := strings.Split(s.message, "\n")
-		for _, l := range lines {
-			l = strings.TrimSpace(l)
-			if l == "" {
+	// drop fails all queued messages to a channel.
+	drop := func(channel string, err error) {
+		rest := []*controlMessage{}
+		for _, s := range sayqueue {
+			if s.channel != channel {
+				rest = append(rest, s)
 				continue
 			}
-			err := i.irc.WriteMessage(&irc.Message{
-				Command: "PRIVMSG",
-				Params: []string{
-					i.channel,
-					l,
-				},
-			})
+			glog.Infof("IRC/%s/say: [drop] %q", i.user, s.message)
+			s.done <- err
+		}
+		sayqueue = rest
+	}
+	join := func(channel string) {
+		if joined[channel] {
+			return
+		}
+		if _, ok := joining[channel]; ok {
+			return
+		}
+		glog.Infof("IRC/%s/info: joining %s...", i.user, channel)
+		joining[channel] = time.Now()
+		i.irc.Write("JOIN " + channel)
+	}
+	// leave marks a channel as not joined anymore, and returns whether the
+	// connection is still useful (ie. is joined or is joining any channel).
+	leave := func(channel string) bool {
+		delete(joined, channel)
+		delete(joining, channel)
+		delete(names, channel)
+		i.setJoined(channel, false)
+		return len(joined) > 0 || len(joining) > 0
+	}
+	// flush sends queued lines, as far as flood control allows, and arranges
+	// for floodC to fire when more can be sent.
+	flush := func() {
+		for len(outq) > 0 && !dead {
+			if s := outq[0].s; !s.start() {
+				// The sender gave up on the message before any of it was
+				// sent.
+				glog.Infof("IRC/%s/say: [cancelled] %q", i.user, s.message)
+				for len(outq) > 0 && outq[0].s == s {
+					outq = outq[1:]
+				}
+				i.depth.Set(int64(len(outq)))
+				s.done <- fmt.Errorf("%w: cancelled by sender", ErrTimeout)
+				continue
+			}
+
+			wait := i.limit.take()
+			if wait == 0 {
+				wait = i.global.take()
+				if wait != 0 {
+					i.limit.refund()
+				}
+			}
+			if wait != 0 {
+				metricLinesThrottled.Add(i.server, 1)
+				floodC = time.After(wait)
+				return
+			}
+
+			l := outq[0]
+			outq = outq[1:]
+			i.depth.Set(int64(len(outq)))
+			err := i.irc.WriteMessage(l.m)
 			if err != nil {
 				glog.Errorf("IRC/%s: WriteMessage: %v", i.user, err)
+				err = fmt.Errorf("%w: %v", ErrConnectionDead, err)
+				if !l.last {
+					// Drop the rest of the message from outq, so that die
+					// doesn't fail it again.
+					for len(outq) > 0 && outq[0].s == l.s {
+						outq = outq[1:]
+					}
+				}
+				l.s.done <- err
 				die(err)
-				s.done <- err
 				return
 			}
+			metricLinesSent.Add(i.server, 1)
+			if l.last {
+				l.s.done <- nil
+			}
+		}
+	}
+	// msg queues a message for sending, line by line.
+	msg := func(s *controlMessage) {
+		// Lines are split to fit into what the server relays to others.
+		budget := lineBudget(nick, userhost, s.channel, s.action)
+		lines := []*outLine{}
+		for _, l := range splitText(s.message, budget) {
+			if s.action {
+				l = ctcpAction(l)
+			}
+			m := &irc.Message{
+				Command: "PRIVMSG",
+				Params: []string{
+					s.channel,
+					l,
+				},
+			}
+			if tags && s.replyTo != "" {
+				m.Tags = irc.Tags{
+					"+draft/reply": irc.TagValue(s.replyTo),
+				}
+			}
+			lines = append(lines, &outLine{m: m, s: s})
+		}
+		if len(lines) == 0 {
+			s.done <- nil
+			return
+		}
+		lines[len(lines)-1].last = true
+		outq = append(outq, lines...)
+		i.depth.Set(int64(len(outq)))
+		if floodC == nil {
+			flush()
 		}
-		s.done <- nil
 	}
 
-	// Timeout ticker - give up connecting to IRC after 15 seconds.
-	t := time.NewTicker(time.Second * 30)
+	// Timeout ticker - give up connecting to IRC, or joining a channel, after
+	// 30 seconds.
+	const timeout = 30 * time.Second
+	t := time.NewTicker(time.Second * 5)
 
 	previousNick := ""
+	// whether we got past registration (001)
+	registered := false
+	// number of unanswered CAP REQs, whether we're in the middle of SASL
+	// authentication, and whether capability negotiation has ended
+	capPending := len(i.caps())
+	authenticating := false
+	authenticated := false
+	// SASL mechanisms supported by the server, if it told us (908
+	// RPL_SASLMECHS)
+	saslMechs := ""
+	capDone := false
+	capEnd := func() {
+		if capPending <= 0 && !authenticating && !capDone {
+			i.irc.Write("CAP END")
+			capDone = true
+		}
+	}
+	// index into i.nicks of the nick we're attempting to register with
+	nickAttempt := 0
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 
+		case <-floodC:
+			floodC = nil
+			flush()
+
 		case <-i.eq:
 			glog.Infof("IRC/%s/info: got evicted", i.user)
-			die(fmt.Errorf("evicted"))
+			die(ErrEvicted)
+			return
+
+		case err := <-i.xq:
+			glog.Infof("IRC/%s/info: IRC client exited", i.user)
+			die(fmt.Errorf("%w: %v", ErrConnectionDead, err))
 			return
 
 		case m := <-i.iq:
@@ -246,49 +708,203 @@ func (i *ircconn) loop(ctx context.Context) {
 				glog.V(1).Infof("IRC/%s/debug: %+v", i.user, m)
 			}
 
-			glog.V(16).Infof("irc/debug16: Message: cmd(%s), channel(%s)", m.Command, m.Params[0])
-			glog.V(16).Infof("irc/debug16: Current: channel(%s), command(%s)", i.channel, "PRIVMSG")
-			glog.V(16).Infof("irc/debug16: Current: channel-eq(%t), command-eq(%t)", i.channel == m.Params[0], "PRIVMSG" == m.Command)
+			// Learn our user@host from our own messages (eg. JOINs), or from
+			// the server hiding our host (396 RPL_VISIBLEHOST).
+			if m.Prefix != nil && m.Prefix.Name == nick && m.Prefix.User != "" && m.Prefix.Host != "" {
+				userhost = m.Prefix.User + "@" + m.Prefix.Host
+			}
+			if m.Command == "396" && len(m.Params) > 1 {
+				userhost = strings.SplitN(userhost, "@", 2)[0] + "@" + m.Params[1]
+			}
+
+			// channel the message is about, if any
+			channel := ""
+			if len(m.Params) > 0 {
+				channel = strings.ToLower(m.Params[0])
+			}
+			glog.V(16).Infof("irc/debug16: Message: cmd(%s), channel(%s), joined(%t)", m.Command, channel, joined[channel])
 			switch {
+			case (m.Command == "432" || m.Command == "433" || m.Command == "437") && !registered:
+				// Our nick is erroneous, in use or unavailable. Only handle
+				// errors about the nick we last requested.
+				if len(m.Params) < 2 || m.Params[1] != i.nicks[nickAttempt] {
+					break
+				}
+				nickAttempt += 1
+				if nickAttempt >= len(i.nicks) {
+					glog.Errorf("IRC/%s/info: no usable nick left, dying", i.user)
+					die(ErrNoNick)
+					return
+				}
+				nick = i.nicks[nickAttempt]
+				glog.Infof("IRC/%s/info: nick %s unusable (%s), trying %s...", i.user, m.Params[1], m.Command, nick)
+				i.irc.Writef("NICK :%s", nick)
+
+			case m.Command == "432" || m.Command == "433" || m.Command == "437":
+				// A nick change was refused after registering (eg. one
+				// forced on us by the server), we keep our current nick.
+				glog.Warningf("IRC/%s/info: nick change refused (%s), keeping %s", i.user, m.Command, nick)
+
+			case m.Command == "001" && i.sasl != nil && !authenticated:
+				// The server ignored our CAP REQ (or answered it with 421),
+				// and registered us without authenticating.
+				glog.Errorf("IRC/%s/info: registered without SASL authentication", i.user)
+				i.saslFailed(die, "SASL not supported by server")
+				return
+
 			case m.Command == "001":
-				glog.Infof("IRC/%s/info: joining %s...", i.user, i.channel)
-				i.irc.Write("JOIN " + i.channel)
+				registered = true
+				if len(m.Params) > 0 {
+					nick = m.Params[0]
+				}
+				for _, c := range i.channels {
+					join(c)
+				}
+				// Join channels of messages that came in while registering.
+				for _, s := range sayqueue {
+					join(s.channel)
+				}
+
+			case m.Command == "CAP" && len(m.Params) > 2 && (m.Params[1] == "ACK" || m.Params[1] == "NAK"):
+				capPending -= 1
+				for _, c := range strings.Fields(m.Params[2]) {
+					switch {
+					case c == "message-tags" && m.Params[1] == "ACK":
+						tags = true
+					case c == "sasl" && m.Params[1] == "ACK" && i.sasl != nil:
+						glog.Infof("IRC/%s/info: authenticating with SASL %s...", i.user, i.sasl.Mechanism)
+						authenticating = true
+						i.irc.Write("AUTHENTICATE " + strings.ToUpper(i.sasl.Mechanism))
+					case c == "sasl" && m.Params[1] == "NAK" && i.sasl != nil:
+						glog.Errorf("IRC/%s/info: server does not support SASL", i.user)
+						i.saslFailed(die, "SASL not supported by server")
+						return
+					}
+				}
+				capEnd()
+
+			case m.Command == "AUTHENTICATE" && i.sasl != nil:
+				if len(m.Params) > 0 && m.Params[0] == "+" {
+					for _, p := range i.sasl.payload() {
+						i.irc.Write("AUTHENTICATE " + p)
+					}
+				}
+
+			case m.Command == "903":
+				glog.Infof("IRC/%s/info: SASL authentication succeeded", i.user)
+				authenticating = false
+				authenticated = true
+				capEnd()
 
-			case m.Command == "353":
-				glog.Infof("IRC/%s/info: joined and ready", i.user)
-				connected = true
-				atomic.StoreInt64(&i.connected, 1)
+			case m.Command == "908" && len(m.Params) > 1:
+				// Sent before 904 if our mechanism is not supported.
+				saslMechs = m.Params[1]
+
+			case m.Command == "902" || m.Command == "904" || m.Command == "905" || m.Command == "906":
+				reason := m.Trailing()
+				if saslMechs != "" {
+					reason += " (server supports " + saslMechs + ")"
+				}
+				glog.Errorf("IRC/%s/info: SASL authentication failed: %s", i.user, reason)
+				i.saslFailed(die, reason)
+				return
+
+			case m.Command == "353" && len(m.Params) > 3:
+				// RPL_NAMREPLY: <nick> <type> <channel> :<names>
+				c := strings.ToLower(m.Params[2])
+				if _, ok := joining[c]; !ok && !joined[c] {
+					break
+				}
+				if names[c] == nil {
+					names[c] = make(map[string]bool)
+				}
+				for _, n := range strings.Fields(m.Params[3]) {
+					names[c][stripNamePrefix(n)] = true
+				}
+				if joined[c] {
+					break
+				}
+				glog.Infof("IRC/%s/info: joined %s and ready", i.user, c)
+				delete(joining, c)
+				joined[c] = true
+				i.setJoined(c, true)
 				// drain queue of say messages...
+				backlog := []*controlMessage{}
+				rest := []*controlMessage{}
 				for _, s := range sayqueue {
+					if s.channel == c {
+						backlog = append(backlog, s)
+					} else {
+						rest = append(rest, s)
+					}
+				}
+				sayqueue = rest
+				for j, s := range backlog {
 					glog.Infof("IRC/%s/say: [backlog] %q", i.user, s.message)
 					msg(s)
+					if dead {
+						for _, s := range backlog[j+1:] {
+							s.done <- i.err
+						}
+						return
+					}
 				}
-				sayqueue = []*controlMessage{}
 
-			case m.Command == "474":
+			case m.Command == "474" && len(m.Params) > 1:
 				// We are banned! :(
-				glog.Infof("IRC/%s/info: banned!", i.user)
-				go i.eventHandler(&event{
-					banned: &eventBanned{i},
+				c := strings.ToLower(m.Params[1])
+				glog.Infof("IRC/%s/info: banned from %s!", i.user, c)
+				i.emit(&event{
+					banned: &eventBanned{i, c},
 				})
-				die(nil)
-				return
+				drop(c, ErrBanned)
+				if !leave(c) {
+					die(ErrBanned)
+					return
+				}
 
-			case m.Command == "KICK" && m.Params[1] == i.irc.CurrentNick():
-				glog.Infof("IRC/%s/info: got kicked", i.user)
-				die(nil)
-				return
-			case m.Command == "PRIVMSG" && strings.ToLower(m.Params[0]) == i.channel:
-				glog.V(8).Infof("IRC/%s/debug8: received message on %s", i.user, i.channel)
-				go i.eventHandler(&event{
-					message: &eventMessage{i, m.Prefix.Name, m.Params[1]},
+			case m.Command == "KICK" && len(m.Params) > 1 && m.Params[1] == nick:
+				glog.Infof("IRC/%s/info: got kicked from %s", i.user, channel)
+				if !leave(channel) {
+					die(fmt.Errorf("%w: kicked from %s", ErrConnectionDead, channel))
+					return
+				}
+
+			case m.Command == "PRIVMSG" && len(m.Params) > 1 && joined[channel]:
+				glog.V(8).Infof("IRC/%s/debug8: received message on %s", i.user, channel)
+				text, action := parseCTCPAction(m.Params[1])
+				id, _ := m.GetTag("msgid")
+				replyTo, _ := m.GetTag("+draft/reply")
+				i.emit(&event{
+					message: &eventMessage{i, channel, m.Prefix.Name, text, action, id, replyTo},
+				})
+
+			case m.Command == "NOTICE" && len(m.Params) > 1 && joined[channel] && m.Prefix != nil:
+				glog.V(8).Infof("IRC/%s/debug8: received notice on %s", i.user, channel)
+				i.emit(&event{
+					notice: &eventNotice{i, channel, m.Prefix.Name, m.Params[1]},
+				})
+
+			case m.Command == "TOPIC" && len(m.Params) > 1 && joined[channel] && m.Prefix != nil:
+				glog.V(8).Infof("IRC/%s/debug8: topic changed on %s", i.user, channel)
+				i.emit(&event{
+					topic: &eventTopic{i, channel, m.Prefix.Name, m.Params[1]},
 				})
+
+			case m.Prefix != nil:
+				for _, p := range i.presence(m, joined, names) {
+					i.emit(&event{
+						presence: p,
+					})
+				}
 			}
 
-			// update nickmap if needed
-			nick := i.irc.CurrentNick()
-			if previousNick != nick {
-				i.eventHandler(&event{
+			if m.Command == "NICK" && len(m.Params) > 0 && m.Prefix != nil && m.Prefix.Name == nick {
+				nick = m.Params[0]
+			}
+			// update nickmap if needed, once the server confirmed our nick
+			if registered && previousNick != nick {
+				i.emit(&event{
 					nick: &eventNick{i, nick},
 				})
 				previousNick = nick
@@ -297,21 +913,31 @@ func (i *ircconn) loop(ctx context.Context) {
 		case s := <-i.sq:
 			if dead {
 				glog.Infof("IRC/%s/say: [DEAD] %q", i.user, s.message)
-				s.done <- fmt.Errorf("connection is dead")
-			} else if connected {
-				glog.Infof("IRC/%s/say: %s", i.user, s.message)
+				s.done <- i.err
+			} else if joined[s.channel] {
+				glog.Infof("IRC/%s/say: %s: %s", i.user, s.channel, s.message)
 				msg(s)
 			} else {
-				glog.Infof("IRC/%s/say: [writeback] %q", i.user, s.message)
+				glog.Infof("IRC/%s/say: [writeback] %s: %q", i.user, s.channel, s.message)
 				sayqueue = append(sayqueue, s)
+				if registered {
+					join(s.channel)
+				}
 			}
 
 		case <-t.C:
-			if !connected {
+			if len(joined) == 0 && time.Since(start) > timeout {
 				glog.Errorf("IRC/%s/info: connection timed out, dying", i.user)
-				die(fmt.Errorf("connection timeout"))
+				die(fmt.Errorf("%w: connecting", ErrTimeout))
 				return
 			}
+			for c, since := range joining {
+				if time.Since(since) > timeout {
+					glog.Errorf("IRC/%s/info: joining %s timed out", i.user, c)
+					drop(c, fmt.Errorf("%w: joining %s", ErrTimeout, c))
+					leave(c)
+				}
+			}
 		}
 	}
 }
@@ -0,0 +1,119 @@
+package irc
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	// metricQueueDepth is the number of lines waiting to be sent, per
+	// connection (server/user).
+	metricQueueDepth = expvar.NewMap("irc_send_queue_depth")
+	// metricLinesSent is the number of lines sent, per server.
+	metricLinesSent = expvar.NewMap("irc_lines_sent")
+	// metricLinesThrottled is the number of times a line had to wait for
+	// flood control, per server.
+	metricLinesThrottled = expvar.NewMap("irc_lines_throttled")
+)
+
+// RateLimit configures flood control of lines sent to IRC, as a token bucket
+// allowing bursts of Burst lines, refilled at Rate lines per second. A zero
+// Rate disables flood control.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ServerFlood is flood control shared by all connections to an IRC server,
+// even across Managers. A nil ServerFlood never limits.
+type ServerFlood struct {
+	bucket *tokenBucket
+}
+
+// NewServerFlood returns flood control for all connections to a server, or nil
+// if the RateLimit disables it.
+func NewServerFlood(l RateLimit) *ServerFlood {
+	b := newTokenBucket(l)
+	if b == nil {
+		return nil
+	}
+	return &ServerFlood{bucket: b}
+}
+
+// tokens returns the token bucket of the flood control, or nil.
+func (f *ServerFlood) tokens() *tokenBucket {
+	if f == nil {
+		return nil
+	}
+	return f.bucket
+}
+
+// tokenBucket is a flood control token bucket. A nil tokenBucket never
+// limits. It is safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full tokenBucket for a RateLimit, or nil if the
+// RateLimit disables flood control.
+func newTokenBucket(l RateLimit) *tokenBucket {
+	if l.Rate <= 0 {
+		return nil
+	}
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   l.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// refill adds tokens accumulated since the last refill. It must be called
+// with mu held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take takes a token from the bucket and returns zero if one is available.
+// Otherwise, it returns how long to wait until one is.
+func (b *tokenBucket) take() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// refund returns a token taken from the bucket, eg. if it could not be used
+// because another bucket was empty.
+func (b *tokenBucket) refund() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += 1
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
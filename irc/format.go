@@ -0,0 +1,117 @@
+package irc
+
+import (
+	"strings"
+)
+
+// Style is the formatting of a run of IRC text. Colours have no equivalent
+// outside of IRC, and are not kept.
+type Style struct {
+	Bold          bool
+	Italic        bool
+	Underline     bool
+	Strikethrough bool
+	Monospace     bool
+}
+
+// Span is a run of IRC text with a single Style.
+type Span struct {
+	Text string
+	Style
+}
+
+// ParseFormatting parses mIRC formatting codes in text into spans of
+// uniformly formatted text. Colour and reverse codes are stripped.
+func ParseFormatting(text string) []Span {
+	spans := []Span{}
+	style := Style{}
+	var b strings.Builder
+	// emit ends the current span, before the style changes.
+	emit := func() {
+		if b.Len() == 0 {
+			return
+		}
+		if n := len(spans); n > 0 && spans[n-1].Style == style {
+			spans[n-1].Text += b.String()
+		} else {
+			spans = append(spans, Span{Text: b.String(), Style: style})
+		}
+		b.Reset()
+	}
+
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\x02':
+			emit()
+			style.Bold = !style.Bold
+		case '\x1d':
+			emit()
+			style.Italic = !style.Italic
+		case '\x1f':
+			emit()
+			style.Underline = !style.Underline
+		case '\x1e':
+			emit()
+			style.Strikethrough = !style.Strikethrough
+		case '\x11':
+			emit()
+			style.Monospace = !style.Monospace
+		case '\x0f':
+			emit()
+			style = Style{}
+		case '\x16':
+			// Reverse colours.
+		case '\x03':
+			// Colour: up to two digits, optionally followed by a comma and
+			// up to two digits of background.
+			i += colourLen(text[i+1:], isDigit, 2)
+		case '\x04':
+			// Hex colour: six hex digits, optionally followed by a comma and
+			// six hex digits of background.
+			i += colourLen(text[i+1:], isHex, 6)
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+	emit()
+	return spans
+}
+
+// StripFormatting returns text without mIRC formatting codes.
+func StripFormatting(text string) string {
+	var b strings.Builder
+	for _, s := range ParseFormatting(text) {
+		b.WriteString(s.Text)
+	}
+	return b.String()
+}
+
+// colourLen returns the length of the colour parameters at the beginning of
+// s, made of up to n characters matching valid, optionally followed by a comma
+// and up to n more.
+func colourLen(s string, valid func(byte) bool, n int) int {
+	fg := 0
+	for fg < n && fg < len(s) && valid(s[fg]) {
+		fg++
+	}
+	if fg == 0 || fg >= len(s) || s[fg] != ',' {
+		return fg
+	}
+	bg := 0
+	for bg < n && fg+1+bg < len(s) && valid(s[fg+1+bg]) {
+		bg++
+	}
+	if bg == 0 {
+		// The comma is part of the text.
+		return fg
+	}
+	return fg + 1 + bg
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,604 @@
+// Package irctest provides an in-process fake IRC server, for end-to-end tests
+// of code talking to IRC.
+package irctest
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irc "gopkg.in/irc.v3"
+)
+
+// Host is the host of all users on the fake server.
+const Host = "irctest.example.com"
+
+// Message is a PRIVMSG sent to a channel by a client of the fake server.
+type Message struct {
+	Nick    string
+	Channel string
+	Text    string
+	Tags    irc.Tags
+}
+
+// Server is a fake IRC server. It implements registration (with optional
+// message-tags capability), JOIN with RPL_NAMREPLY, PART, QUIT, NICK and
+// PRIVMSG fan-out to channel members, and records all channel messages sent by
+// clients. Tests script other users, bans, kicks, forced nick changes and
+// disconnects through its methods.
+type Server struct {
+	// Addr is the address to connect to.
+	Addr string
+	// Tags is whether the server acknowledges the message-tags capability,
+	// and tags relayed messages with message IDs. It must be set before
+	// clients connect.
+	Tags bool
+	// NoCap is whether the server doesn't support capability negotiation,
+	// and answers CAP with 421 ERR_UNKNOWNCOMMAND. It must be set before
+	// clients connect.
+	NoCap bool
+
+	l  net.Listener
+	mu sync.Mutex
+	// connected clients, and members of each (lowercased) channel
+	clients  map[*client]bool
+	channels map[string]map[*client]bool
+	// banned usernames per channel, and nicks in use by users not connected
+	// to the server
+	bans     map[string]map[string]bool
+	reserved map[string]bool
+	// ID of the next relayed message
+	nextID   int
+	messages []*Message
+	// changed is closed and replaced whenever clients, channels or messages
+	// change
+	changed chan struct{}
+	wg      sync.WaitGroup
+}
+
+// client is a connection to the fake server.
+type client struct {
+	conn net.Conn
+	w    *irc.Writer
+	// guards w
+	wmu sync.Mutex
+
+	nick string
+	user string
+	// capability negotiation is in progress
+	capping    bool
+	tags       bool
+	registered bool
+}
+
+// NewServer starts a fake IRC server on a random local port.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:     l.Addr().String(),
+		l:        l,
+		clients:  make(map[*client]bool),
+		channels: make(map[string]map[*client]bool),
+		bans:     make(map[string]map[string]bool),
+		reserved: make(map[string]bool),
+		nextID:   1,
+		changed:  make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Close stops the server and disconnects all clients.
+func (s *Server) Close() {
+	s.l.Close()
+	s.mu.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// notify wakes up everyone waiting for changes. It must be called with mu
+// held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until cond (called with mu held) is true.
+func (s *Server) wait(cond func() bool, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		ok := cond()
+		s.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Reserve marks a nick as used by someone else, so that clients registering
+// with it get ERR_NICKNAMEINUSE.
+func (s *Server) Reserve(nick string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reserved[strings.ToLower(nick)] = true
+}
+
+// Ban bans a username from a channel. Clients with that username get
+// ERR_BANNEDFROMCHAN when joining.
+func (s *Server) Ban(channel, user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := strings.ToLower(channel)
+	if s.bans[c] == nil {
+		s.bans[c] = make(map[string]bool)
+	}
+	s.bans[c][user] = true
+}
+
+// Say sends a message to a channel from a user that is not connected to the
+// server.
+func (s *Server) Say(nick, channel, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := &irc.Message{
+		Prefix:  &irc.Prefix{Name: nick, User: nick, Host: Host},
+		Command: "PRIVMSG",
+		Params:  []string{channel, text},
+	}
+	s.relay(strings.ToLower(channel), nil, m)
+}
+
+// Kick kicks a client by nick from a channel.
+func (s *Server) Kick(channel, nick, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := strings.ToLower(channel)
+	c := s.member(ch, nick)
+	if c == nil {
+		return fmt.Errorf("%s is not on %s", nick, channel)
+	}
+	s.broadcast(ch, nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "op", User: "op", Host: Host},
+		Command: "KICK",
+		Params:  []string{channel, c.nick, reason},
+	})
+	delete(s.channels[ch], c)
+	s.notify()
+	return nil
+}
+
+// Rename forces a nick change on a client, like services do.
+func (s *Server) Rename(nick, newNick string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(nick)
+	if c == nil {
+		return fmt.Errorf("%s is not connected", nick)
+	}
+	m := &irc.Message{Prefix: c.prefix(), Command: "NICK", Params: []string{newNick}}
+	c.write(m)
+	for ch := range s.channels {
+		if s.channels[ch][c] {
+			s.broadcast(ch, c, m)
+		}
+	}
+	c.nick = newNick
+	s.notify()
+	return nil
+}
+
+// Reply sends a numeric reply from the server to a client, eg. an error about
+// a command it did not send.
+func (s *Server) Reply(nick, command string, params ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(nick)
+	if c == nil {
+		return fmt.Errorf("%s is not connected", nick)
+	}
+	c.write(&irc.Message{
+		Prefix:  &irc.Prefix{Name: Host},
+		Command: command,
+		Params:  append([]string{c.nick}, params...),
+	})
+	return nil
+}
+
+// Disconnect drops the connection of a client by nick, without a QUIT.
+func (s *Server) Disconnect(nick string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(nick)
+	if c == nil {
+		return fmt.Errorf("%s is not connected", nick)
+	}
+	c.conn.Close()
+	return nil
+}
+
+// Members returns the sorted nicks of the clients on a channel.
+func (s *Server) Members(channel string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.members(strings.ToLower(channel))
+}
+
+// WaitMember waits until a nick is (or is not) on a channel.
+func (s *Server) WaitMember(channel, nick string, present bool, timeout time.Duration) error {
+	ch := strings.ToLower(channel)
+	ok := s.wait(func() bool {
+		return (s.member(ch, nick) != nil) == present
+	}, timeout)
+	if !ok {
+		return fmt.Errorf("%s on %s is %v, wanted %v (members: %v)", nick, channel, !present, present, s.Members(channel))
+	}
+	return nil
+}
+
+// WaitConnected waits until a client with a given nick is (or is not)
+// connected.
+func (s *Server) WaitConnected(nick string, connected bool, timeout time.Duration) error {
+	ok := s.wait(func() bool {
+		return (s.client(nick) != nil) == connected
+	}, timeout)
+	if !ok {
+		return fmt.Errorf("%s connected is %v, wanted %v", nick, !connected, connected)
+	}
+	return nil
+}
+
+// Messages returns all channel messages sent by clients.
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message{}, s.messages...)
+}
+
+// WaitMessages waits until at least n channel messages were sent by clients,
+// and returns them.
+func (s *Server) WaitMessages(n int, timeout time.Duration) ([]*Message, error) {
+	ok := s.wait(func() bool {
+		return len(s.messages) >= n
+	}, timeout)
+	msgs := s.Messages()
+	if !ok {
+		return msgs, fmt.Errorf("got %d messages, wanted %d", len(msgs), n)
+	}
+	return msgs, nil
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{
+			conn: conn,
+			w:    irc.NewWriter(conn),
+		}
+		s.mu.Lock()
+		s.clients[c] = true
+		s.notify()
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+// serve handles messages from a client until it disconnects.
+func (s *Server) serve(c *client) {
+	defer s.wg.Done()
+	r := irc.NewReader(c.conn)
+	for {
+		m, err := r.ReadMessage()
+		if err != nil {
+			s.quit(c, "Connection closed")
+			return
+		}
+		s.mu.Lock()
+		quit := s.handle(c, m)
+		s.mu.Unlock()
+		if quit {
+			s.quit(c, m.Trailing())
+			return
+		}
+	}
+}
+
+// quit removes a client from the server, telling the members of its channels.
+func (s *Server) quit(c *client, reason string) {
+	c.conn.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.clients[c] {
+		return
+	}
+	delete(s.clients, c)
+	m := &irc.Message{
+		Prefix:  c.prefix(),
+		Command: "QUIT",
+		Params:  []string{reason},
+	}
+	for ch := range s.channels {
+		if !s.channels[ch][c] {
+			continue
+		}
+		delete(s.channels[ch], c)
+		s.broadcast(ch, c, m)
+	}
+	s.notify()
+}
+
+// handle handles a message from a client, and returns whether the client quit.
+// It must be called with mu held.
+func (s *Server) handle(c *client, m *irc.Message) bool {
+	// reply sends a numeric reply to the client.
+	reply := func(command string, params ...string) {
+		nick := c.nick
+		if nick == "" {
+			nick = "*"
+		}
+		c.write(&irc.Message{
+			Prefix:  &irc.Prefix{Name: Host},
+			Command: command,
+			Params:  append([]string{nick}, params...),
+		})
+	}
+
+	switch m.Command {
+	case "PING":
+		c.write(&irc.Message{Prefix: &irc.Prefix{Name: Host}, Command: "PONG", Params: m.Params})
+
+	case "CAP":
+		if s.NoCap {
+			reply("421", "CAP", "Unknown command")
+			break
+		}
+		if len(m.Params) < 1 {
+			break
+		}
+		switch m.Params[0] {
+		case "LS":
+			c.capping = true
+			caps := ""
+			if s.Tags {
+				caps = "message-tags"
+			}
+			reply("CAP", "LS", caps)
+		case "REQ":
+			c.capping = true
+			if s.Tags && m.Trailing() == "message-tags" {
+				c.tags = true
+				reply("CAP", "ACK", m.Trailing())
+			} else {
+				reply("CAP", "NAK", m.Trailing())
+			}
+		case "END":
+			c.capping = false
+			s.register(c)
+		}
+
+	case "NICK":
+		if len(m.Params) < 1 {
+			break
+		}
+		nick := m.Params[0]
+		if s.nickInUse(nick, c) {
+			reply("433", nick, "Nickname is already in use")
+			break
+		}
+		if c.registered {
+			nm := &irc.Message{Prefix: c.prefix(), Command: "NICK", Params: []string{nick}}
+			c.write(nm)
+			for ch := range s.channels {
+				if s.channels[ch][c] {
+					s.broadcast(ch, c, nm)
+				}
+			}
+		}
+		c.nick = nick
+		s.register(c)
+
+	case "USER":
+		if len(m.Params) < 1 {
+			break
+		}
+		c.user = m.Params[0]
+		s.register(c)
+
+	case "JOIN":
+		if !c.registered || len(m.Params) < 1 {
+			break
+		}
+		for _, channel := range strings.Split(m.Params[0], ",") {
+			ch := strings.ToLower(channel)
+			if s.channels[ch][c] {
+				continue
+			}
+			if s.bans[ch][c.user] {
+				reply("474", channel, "Cannot join channel (+b)")
+				continue
+			}
+			if s.channels[ch] == nil {
+				s.channels[ch] = make(map[*client]bool)
+			}
+			s.channels[ch][c] = true
+			s.broadcast(ch, nil, &irc.Message{Prefix: c.prefix(), Command: "JOIN", Params: []string{channel}})
+			reply("353", "=", channel, strings.Join(s.members(ch), " "))
+			reply("366", channel, "End of /NAMES list.")
+		}
+		s.notify()
+
+	case "PART":
+		if len(m.Params) < 1 {
+			break
+		}
+		ch := strings.ToLower(m.Params[0])
+		if !s.channels[ch][c] {
+			break
+		}
+		s.broadcast(ch, nil, &irc.Message{Prefix: c.prefix(), Command: "PART", Params: m.Params})
+		delete(s.channels[ch], c)
+		s.notify()
+
+	case "PRIVMSG", "NOTICE":
+		if len(m.Params) < 2 {
+			break
+		}
+		ch := strings.ToLower(m.Params[0])
+		if !s.channels[ch][c] {
+			reply("404", m.Params[0], "Cannot send to channel")
+			break
+		}
+		r := &irc.Message{
+			Tags:    irc.Tags{},
+			Prefix:  c.prefix(),
+			Command: m.Command,
+			Params:  m.Params,
+		}
+		if c.tags {
+			// Only pass on client-only tags.
+			for k, v := range m.Tags {
+				if strings.HasPrefix(k, "+") {
+					r.Tags[k] = v
+				}
+			}
+		}
+		if m.Command == "PRIVMSG" {
+			s.messages = append(s.messages, &Message{
+				Nick:    c.nick,
+				Channel: ch,
+				Text:    m.Params[1],
+				Tags:    r.Tags,
+			})
+			s.notify()
+		}
+		s.relay(ch, c, r)
+
+	case "QUIT":
+		return true
+	}
+	return false
+}
+
+// register welcomes a client once it sent its nick and username, and ended
+// capability negotiation. It must be called with mu held.
+func (s *Server) register(c *client) {
+	if c.registered || c.capping || c.nick == "" || c.user == "" {
+		return
+	}
+	c.registered = true
+	c.write(&irc.Message{
+		Prefix:  &irc.Prefix{Name: Host},
+		Command: "001",
+		Params:  []string{c.nick, "Welcome to the fake IRC network " + c.prefix().String()},
+	})
+	s.notify()
+}
+
+// nickInUse returns whether a nick is used by anyone but a given client. It
+// must be called with mu held.
+func (s *Server) nickInUse(nick string, self *client) bool {
+	if s.reserved[strings.ToLower(nick)] {
+		return true
+	}
+	c := s.client(nick)
+	return c != nil && c != self
+}
+
+// client returns the connected client with a given nick, or nil. It must be
+// called with mu held.
+func (s *Server) client(nick string) *client {
+	for c := range s.clients {
+		if strings.EqualFold(c.nick, nick) {
+			return c
+		}
+	}
+	return nil
+}
+
+// member returns the client with a given nick on a channel, or nil. It must be
+// called with mu held.
+func (s *Server) member(channel, nick string) *client {
+	for c := range s.channels[channel] {
+		if strings.EqualFold(c.nick, nick) {
+			return c
+		}
+	}
+	return nil
+}
+
+// members returns the sorted nicks of the clients on a channel. It must be
+// called with mu held.
+func (s *Server) members(channel string) []string {
+	res := []string{}
+	for c := range s.channels[channel] {
+		res = append(res, c.nick)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// relay sends a channel message to all members of the channel but from,
+// tagging it with a message ID for members that support message tags. It must
+// be called with mu held.
+func (s *Server) relay(channel string, from *client, m *irc.Message) {
+	id := strconv.Itoa(s.nextID)
+	s.nextID++
+	for c := range s.channels[channel] {
+		if c == from {
+			continue
+		}
+		r := m.Copy()
+		r.Tags = irc.Tags{}
+		if c.tags {
+			for k, v := range m.Tags {
+				r.Tags[k] = v
+			}
+			r.Tags["msgid"] = irc.TagValue(id)
+		}
+		c.write(r)
+	}
+}
+
+// broadcast sends a message to all members of a channel but except. It must be
+// called with mu held.
+func (s *Server) broadcast(channel string, except *client, m *irc.Message) {
+	for c := range s.channels[channel] {
+		if c != except {
+			c.write(m)
+		}
+	}
+}
+
+func (c *client) prefix() *irc.Prefix {
+	return &irc.Prefix{Name: c.nick, User: "~" + c.user, Host: Host}
+}
+
+// write sends a message to the client. Errors are ignored, as they will make
+// the client's reads fail too.
+func (c *client) write(m *irc.Message) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.WriteMessage(m)
+}
@@ -2,12 +2,14 @@ package irc
 
 import (
 	"context"
+	"crypto/tls"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 )
 
-// Manager maintains a set of IRC connections to a server and channel. Its has
+// Manager maintains a set of IRC connections to a server and channels. Its has
 // three interfaces to the outside world:
 //  - control, from the owner of Manager (eg. a bridge to another protocol)
 //    that allows sending messages as a given user and to subscribe to
@@ -17,10 +19,15 @@ import (
 //  - subscriptions, that pass received messages from IRC to a channel requested
 //    by control.
 //
-// The Manager will maintain exactly one 'receiver', which is an IRC connection
-// that is used as a source of truth for messages on an IRC channel. This will
-// either be an existing connection for a user, or a 'backup' connection that
-// will close as soon as a real/named connection exists and is fully connected.
+// Each connection is shared by all channels, and joins channels as it needs to
+// send messages to them.
+//
+// The Manager will maintain exactly one 'receiver' per channel, which is an IRC
+// connection that is used as a source of truth for messages on that IRC
+// channel. This will either be an existing connection for a user that joined
+// the channel, or a 'backup' connection that joins all channels and will close
+// as soon as real/named connections exist and are fully connected to all
+// channels.
 type Manager struct {
 	// maximum IRC sessions to maintain
 	max int
@@ -28,67 +35,148 @@ type Manager struct {
 	login string
 	// IRC server address
 	server string
-	// IRC channel name
-	channel string
+	// IRC channel names
+	channels []string
 	// control channel (from owner)
 	ctrl chan *control
 	// event channel (from connections)
 	event chan *event
+	// closed when Run returns
+	stopped chan struct{}
 	// map from user name to IRC connection
 	conns map[string]*ircconn
 	// map from user name to IRC nick
 	nickmap map[string]string
-	// set of users that we shouldn't attempt to bridge, and their expiry times
-	shitlist map[string]time.Time
-	// set of subscribing channels for notifications
-	subscribers map[chan *Notification]bool
+	// set of users and channels that we shouldn't attempt to bridge, and
+	// their expiry times
+	shitlist map[userChannel]time.Time
+	// set of users that failed SASL authentication and will connect without
+	// it, and their expiry times
+	saslFallback map[string]time.Time
+	// map from subscribing channels for notifications to their
+	// subscriptions
+	subscribers map[chan *Notification]*subscriber
 	// context representing the Manager lifecycle
 	runctx context.Context
 	// irc nick prefix
 	prefix string
 	// irc nick suffix
 	suffix string
+	// TLS configuration for IRC connections, or nil for plaintext
+	tls *tls.Config
+	// SASL credentials of the backup connection, or nil
+	sasl *SASLCredentials
+	// SASL credentials of named connections
+	credentials CredentialStore
+	// flood control of each connection
+	limit RateLimit
+	// flood control of all connections to the server
+	flood *ServerFlood
+}
+
+// userChannel is a user on an IRC channel.
+type userChannel struct {
+	user    string
+	channel string
 }
 
-func NewManager(max int, server, channel string, login string, prefix string, suffix string) *Manager {
+func NewManager(max int, server string, channels []string, login string, prefix string, suffix string, tlsConfig *tls.Config,
+	sasl *SASLCredentials, credentials CredentialStore, limit RateLimit, flood *ServerFlood) *Manager {
 	return &Manager{
-		max:     max,
-		login:   login,
-		server:  server,
-		channel: channel,
-		prefix:  prefix,
-		suffix:  suffix,
+		max:      max,
+		login:    login,
+		server:   server,
+		channels: channels,
+		prefix:   prefix,
+		suffix:   suffix,
+		tls:      tlsConfig,
+		sasl:     sasl,
+
+		credentials: credentials,
+		limit:       limit,
+		flood:       flood,
+
 		ctrl:    make(chan *control),
 		event:   make(chan *event),
+		stopped: make(chan struct{}),
 	}
 }
 
-// Notifications are sent to subscribers when things happen on IRC
+// Notifications are sent to subscribers when things happen on IRC channels they
+// are subscribed to
 type Notification struct {
 	// A new message appeared on the channel
 	Message *NotificationMessage
 	// Nicks of our connections have changed
 	Nickmap *map[string]string
+	// A new notice appeared on the channel
+	Notice *NotificationMessage
+	// The channel topic has changed
+	Topic *NotificationTopic
+	// Someone joined/left the channel or changed nicks
+	Presence *NotificationPresence
 }
 
-// NotificationMessage is a message that happened in the connected IRC channel
+// NotificationMessage is a message that happened in a subscribed IRC channel
 type NotificationMessage struct {
 	// Nick is the IRC nickname of the sender
 	Nick string
 	// Message is the plaintext message from IRC
 	Message string
+	// Action is set if the message is a CTCP ACTION (/me), in which case
+	// Message is the text of the action, without CTCP framing
+	Action bool
+	// ID is the IRCv3 message ID of the message, if the server supports it
+	ID string
+	// ReplyTo is the IRCv3 message ID of the message this one replies to, if
+	// any
+	ReplyTo string
+}
+
+// NotificationTopic is a topic change of a subscribed IRC channel
+type NotificationTopic struct {
+	// Nick is the IRC nickname of the user that changed the topic
+	Nick string
+	// Topic is the new topic
+	Topic string
+}
+
+// PresenceKind is the kind of a presence change on the IRC channel.
+type PresenceKind int
+
+const (
+	PresenceJoin PresenceKind = iota
+	PresencePart
+	PresenceQuit
+	PresenceKick
+	PresenceNick
+)
+
+// NotificationPresence is a join, part, quit, kick or nick change of someone
+// other than our own connections in a subscribed IRC channel.
+type NotificationPresence struct {
+	Kind PresenceKind
+	// Nick is the IRC nickname of the user that joined or left, the user
+	// that kicked someone, or the old nickname on a nick change
+	Nick string
+	// Target is the kicked nickname, or the new nickname on a nick change
+	Target string
+	// Reason is the part, quit or kick reason, if any
+	Reason string
 }
 
 // Run maintains the main logic of the Manager - servicing control and event
-// messages, and ensuring there is a receiver on the given channel.
+// messages, and ensuring there is a receiver on the given channels.
 func (m *Manager) Run(ctx context.Context) {
 	m.conns = make(map[string]*ircconn)
 	m.nickmap = make(map[string]string)
-	m.shitlist = make(map[string]time.Time)
-	m.subscribers = make(map[chan *Notification]bool)
+	m.shitlist = make(map[userChannel]time.Time)
+	m.saslFallback = make(map[string]time.Time)
+	m.subscribers = make(map[chan *Notification]*subscriber)
 	m.runctx = context.Background()
+	defer close(m.stopped)
 
-	glog.Infof("IRC Manager %s/%s running...", m.server, m.channel)
+	glog.Infof("IRC Manager %s/%s running...", m.server, strings.Join(m.channels, ","))
 
 	t := time.NewTicker(1 * time.Second)
 
@@ -107,63 +195,83 @@ func (m *Manager) Run(ctx context.Context) {
 	}
 }
 
-// ensureReceiver ensures that there is exactly one 'receiver' IRC connection,
-// possibly creating a backup receiver if needed.
+// ensureReceiver ensures that there is exactly one 'receiver' IRC connection
+// per channel, possibly creating a backup receiver if needed.
 func (m *Manager) ensureReceiver(ctx context.Context) {
-	// Ensure backup listener does not exist if there is a named connection
-	active := 0
+	// Ensure backup listener does not exist if there are named connections on
+	// all channels.
+	var backup *ircconn
 	for _, c := range m.conns {
-		if !c.IsConnected() {
-			continue
+		if c.backup {
+			backup = c
 		}
-		active += 1
 	}
-	if active > 1 {
-		var backup *ircconn
-		for _, c := range m.conns {
-			if c.backup {
-				backup = c
+	if backup != nil {
+		covered := true
+		for _, ch := range m.channels {
+			active := false
+			for _, c := range m.conns {
+				if !c.backup && c.IsJoined(ch) {
+					active = true
+				}
+			}
+			if !active {
+				covered = false
 			}
 		}
-		if backup != nil {
+		if covered {
 			glog.Infof("Evicting backup listener")
 			backup.Evict()
 			delete(m.conns, backup.user)
+			backup = nil
 		}
 	}
-	// Ensure there exists exactly one reciever
-	count := 0
-	for _, c := range m.conns {
-		if !c.IsConnected() && !c.backup {
-			c.receiver = false
+
+	for _, ch := range m.channels {
+		// Ensure there exists exactly one reciever
+		count := 0
+		for _, c := range m.conns {
+			if !c.IsJoined(ch) && !c.backup {
+				c.receiver[ch] = false
+				continue
+			}
+			if c.receiver[ch] {
+				count += 1
+			}
+			if count >= 2 {
+				c.receiver[ch] = false
+			}
+		}
+		if count > 0 {
 			continue
 		}
-		if c.receiver {
-			count += 1
+
+		// No receivers? Make first conn on the channel a receiver.
+		elected := false
+		for _, c := range m.conns {
+			if c.IsJoined(ch) {
+				glog.Infof("No receiver found on %s, elected %s for receiver", ch, c.user)
+				c.receiver[ch] = true
+				elected = true
+				break
+			}
 		}
-		if count >= 2 {
-			c.receiver = false
+		if elected {
+			continue
 		}
-	}
-	// No receivers? make one.
-	if count == 0 {
-		if len(m.conns) == 0 {
-			// Noone said anything on telegram, make backup
-			glog.Infof("No receiver found, making backup")
+
+		// No connections on channel, use backup.
+		if backup == nil {
+			glog.Infof("No receiver found on %s, making backup", ch)
 			name := m.login
-			c, err := m.newconn(ctx, name, true)
+			c, err := m.newconn(ctx, name, true, m.channels)
 			if err != nil {
 				glog.Errorf("Could not make backup receiver: %v", err)
-			} else {
-				m.conns[name] = c
-			}
-		} else {
-			// Make first conn a receiver
-			glog.Infof("No receiver found, using conn")
-			for _, v := range m.conns {
-				glog.Infof("Elected %s for receiver", v.user)
-				v.receiver = true
+				return
 			}
+			m.conns[name] = c
+			backup = c
 		}
+		backup.receiver[ch] = true
 	}
 }
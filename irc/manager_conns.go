@@ -2,30 +2,56 @@ package irc
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"time"
 
 	"github.com/golang/glog"
 )
 
+// Errors returned when a message could not be sent to IRC.
 var (
-	errBanned = fmt.Errorf("user is shitlisted")
+	// ErrConnectionDead means the connection of the user died before the
+	// message could be sent.
+	ErrConnectionDead = errors.New("connection is dead")
+	// ErrEvicted means the connection of the user was evicted to make room
+	// for another one before the message could be sent.
+	ErrEvicted = errors.New("connection was evicted")
+	// ErrBanned means the user is banned from the channel. Retrying is
+	// pointless for a while.
+	ErrBanned = errors.New("user is banned")
+	// ErrTimeout means the message could not be sent in time, eg. because
+	// connecting to IRC or joining the channel took too long.
+	ErrTimeout = errors.New("timed out")
+	// ErrPartial means ctx expired while the message was being sent. The rest
+	// of it is still sent, so it should not be sent again.
+	ErrPartial = errors.New("timed out while sending")
+	// ErrNoNick means none of the nicks of the user could be used on IRC.
+	// Retrying is pointless for a while.
+	ErrNoNick = errors.New("no usable nick")
+	// ErrAuthFailed means the connection of the user failed SASL
+	// authentication. The Manager connects the user without SASL for a while
+	// afterwards, so retrying the message is likely to succeed.
+	ErrAuthFailed = errors.New("SASL authentication failed")
 )
 
 // getconn either gets a connection by username, or creates a new one (after
-// evicting the least recently used connection).
-func (m *Manager) getconn(ctx context.Context, userTelegram string) (*ircconn, error) {
-	// Is the user shitlisted?
-	if t, ok := m.shitlist[userTelegram]; ok && time.Now().Before(t) {
-		return nil, errBanned
+// evicting the least recently used connection), to send to a given channel.
+func (m *Manager) getconn(ctx context.Context, userTelegram, channel string) (*ircconn, error) {
+	// Is the user shitlisted on this channel?
+	if t, ok := m.shitlist[userChannel{userTelegram, channel}]; ok && time.Now().Before(t) {
+		return nil, ErrBanned
 	}
 	// Do we already have a connection?
 	c, ok := m.conns[userTelegram]
-	if ok {
+	if ok && !c.IsDead() {
 		// Bump and return.
 		c.last = time.Now()
 		return c, nil
 	}
+	if ok {
+		// Dead, but the manager has not been told yet. Replace it.
+		delete(m.conns, userTelegram)
+	}
 
 	// Are we at the limit of allowed connections?
 	if len(m.conns) >= m.max {
@@ -46,13 +72,13 @@ func (m *Manager) getconn(ctx context.Context, userTelegram string) (*ircconn, e
 	}
 
 	// Allocate new connection
-	return m.newconn(ctx, userTelegram, false)
+	return m.newconn(ctx, userTelegram, false, []string{channel})
 }
 
-// newconn creates a new IRC connection as a given user, and saves it to the
-// conns map.
-func (m *Manager) newconn(ctx context.Context, userTelegram string, backup bool) (*ircconn, error) {
-	c, err := NewConn(m.server, m.channel, userTelegram, backup, m.prefix, m.suffix, m.Event)
+// newconn creates a new IRC connection as a given user joining given channels,
+// and saves it to the conns map.
+func (m *Manager) newconn(ctx context.Context, userTelegram string, backup bool, channels []string) (*ircconn, error) {
+	c, err := NewConn(m.server, channels, userTelegram, backup, m.prefix, m.suffix, m.tls, m.saslFor(userTelegram, backup), m.limit, m.flood.tokens(), m.Event)
 	if err != nil {
 		return nil, err
 	}
@@ -62,3 +88,15 @@ func (m *Manager) newconn(ctx context.Context, userTelegram string, backup bool)
 
 	return c, nil
 }
+
+// saslFor returns the SASL credentials to use for a given user, or nil if the
+// connection should not authenticate.
+func (m *Manager) saslFor(userTelegram string, backup bool) *SASLCredentials {
+	if t, ok := m.saslFallback[userTelegram]; ok && time.Now().Before(t) {
+		return nil
+	}
+	if backup {
+		return m.sasl
+	}
+	return m.credentials[userTelegram]
+}
@@ -2,36 +2,75 @@ package irc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync/atomic"
 
 	"github.com/golang/glog"
 )
 
-// Control: send a message to IRC.
-func (m *Manager) SendMessage(ctx context.Context, user, text string) error {
-	done := make(chan error)
+// Control: send a message to an IRC channel.
+func (m *Manager) SendMessage(ctx context.Context, channel, user, text string) error {
+	return m.SendReply(ctx, channel, user, text, "", false)
+}
+
+// Control: send a message to an IRC channel in reply to a message with a given
+// IRCv3 message ID (if not empty), as a CTCP ACTION (/me) if action is set.
+// The reply is only marked as such if the server supports message tags.
+//
+// If the message cannot be sent, the returned error wraps one of
+// ErrConnectionDead, ErrEvicted, ErrBanned, ErrNoNick, ErrAuthFailed or
+// ErrTimeout (if ctx expired). A message whose connection died or failed SASL
+// authentication is retried once on a new connection before giving up. If ctx
+// expires once some of the message has been sent, the rest is still sent, and
+// ErrPartial is returned.
+func (m *Manager) SendReply(ctx context.Context, channel, user, text, replyTo string, action bool) error {
+	// Buffered, so that the result can be dropped if ctx expires first.
+	done := make(chan error, 1)
 
 	msg := &control{
 		message: &controlMessage{
+			channel: strings.ToLower(channel),
 			from:    user,
 			message: text,
+			replyTo: replyTo,
+			action:  action,
+			state:   new(int32),
 			done:    done,
 		},
 	}
 
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return ctxErr(ctx)
 	case m.ctrl <- msg:
-		return <-done
 	}
+	select {
+	case <-ctx.Done():
+		if msg.message.cancel() {
+			return ctxErr(ctx)
+		}
+		return fmt.Errorf("%w: %v", ErrPartial, ctx.Err())
+	case err := <-done:
+		return err
+	}
+}
+
+// ctxErr returns the error of a done context, as ErrTimeout if it expired.
+func ctxErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %v", ErrTimeout, ctx.Err())
+	}
+	return ctx.Err()
 }
 
-// Control: subscribe to notifiactions.
-func (m *Manager) Subscribe(c chan *Notification) {
+// Control: subscribe to notifiactions about a given IRC channel.
+func (m *Manager) Subscribe(channel string, c chan *Notification) {
 	m.ctrl <- &control{
 		subscribe: &controlSubscribe{
-			c: c,
+			channel: strings.ToLower(channel),
+			c:       c,
 		},
 	}
 }
@@ -46,18 +85,54 @@ type control struct {
 
 // controlMessage is a request to send a message to IRC as a given user
 type controlMessage struct {
+	// IRC channel to send to
+	channel string
 	// user name (native to application)
 	from string
 	// plaintext message
 	message string
+	// IRCv3 message ID that this message replies to, if any
+	replyTo string
+	// whether to send the message as CTCP ACTIONs (/me), line by line
+	action bool
+	// whether this message was already re-routed after its connection died
+	rerouted bool
+	// one of msgQueued, msgSending or msgCancelled, shared by the copies of
+	// the message
+	state *int32
 	// channel that will be sent nil or an error when the message has been
 	// succesfully sent or an error occured
 	done chan error
 }
 
-// controlSubscribe is a request to send notifications to a given channel
+// States of a controlMessage.
+const (
+	// msgQueued messages have not been sent in any part yet.
+	msgQueued int32 = iota
+	// msgSending messages have been sent in part, and will be sent in full.
+	msgSending
+	// msgCancelled messages were given up on by their sender before any of
+	// them was sent, and will not be sent.
+	msgCancelled
+)
+
+// start marks the message as being sent, and returns false if it was
+// cancelled instead.
+func (c *controlMessage) start() bool {
+	return atomic.CompareAndSwapInt32(c.state, msgQueued, msgSending) || atomic.LoadInt32(c.state) == msgSending
+}
+
+// cancel marks the message as cancelled, and returns false if it is being
+// sent already.
+func (c *controlMessage) cancel() bool {
+	return atomic.CompareAndSwapInt32(c.state, msgQueued, msgCancelled) || atomic.LoadInt32(c.state) == msgCancelled
+}
+
+// controlSubscribe is a request to send notifications about a given IRC
+// channel to a given Go channel
 type controlSubscribe struct {
-	c chan *Notification
+	channel string
+	c       chan *Notification
 }
 
 // doctrl processes a given control message.
@@ -68,23 +143,47 @@ func (m *Manager) doctrl(ctx context.Context, c *control) {
 		// Send a message to IRC.
 
 		// Find a relevant connection, or make one.
-		conn, err := m.getconn(ctx, c.message.from)
+		conn, err := m.getconn(ctx, c.message.from, c.message.channel)
 		if err != nil {
-			// Do not attempt to redeliver bans.
-			if err == errBanned {
-				c.message.done <- nil
+			if errors.Is(err, ErrBanned) {
+				c.message.done <- err
 			} else {
-				c.message.done <- fmt.Errorf("getting connection: %v", err)
+				c.message.done <- fmt.Errorf("%w: getting connection: %v", ErrConnectionDead, err)
 			}
 			return
 		}
 
-		// Route message to connection.
-		conn.Say(c.message)
+		// Route message to connection. If the connection dies (or fails to
+		// authenticate) before sending any of it, route it again (through a
+		// new connection) once.
+		say := *c.message
+		say.done = make(chan error, 1)
+		conn.Say(&say)
+		go func() {
+			err := <-say.done
+			if !c.message.rerouted && atomic.LoadInt32(c.message.state) == msgQueued && (errors.Is(err, ErrConnectionDead) || errors.Is(err, ErrEvicted) || errors.Is(err, ErrAuthFailed)) {
+				glog.Warningf("Re-routing message from %s after error: %v", c.message.from, err)
+				c.message.rerouted = true
+				select {
+				case m.ctrl <- c:
+					return
+				case <-ctx.Done():
+					err = ctx.Err()
+				}
+			}
+			c.message.done <- err
+		}()
 
 	case c.subscribe != nil:
-		// Subscribe to notifications.
-		m.subscribers[c.subscribe.c] = true
+		// Subscribe to notifications, or move an existing subscription to
+		// another IRC channel.
+		if s, ok := m.subscribers[c.subscribe.c]; ok {
+			s.channel = c.subscribe.channel
+			return
+		}
+		s := newSubscriber(c.subscribe.channel, c.subscribe.c)
+		m.subscribers[c.subscribe.c] = s
+		go s.forward(ctx)
 
 	default:
 		glog.Errorf("unhandled control %+v", c)
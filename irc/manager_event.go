@@ -2,13 +2,19 @@ package irc
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 )
 
+// Event passes an event from a connection to the Manager, unless the Manager
+// has stopped.
 func (m *Manager) Event(e *event) {
-	m.event <- e
+	select {
+	case m.event <- e:
+	case <-m.stopped:
+	}
 }
 
 // Event: a connection has a new nick.
@@ -36,8 +42,16 @@ type event struct {
 	nick *eventNick
 	// a connection received a new PRIVMSG
 	message *eventMessage
+	// a connection received a new NOTICE
+	notice *eventNotice
+	// a connection saw the channel topic change
+	topic *eventTopic
+	// a connection saw someone join/leave the channel or change nicks
+	presence *eventPresence
 	// a connection is banned
 	banned *eventBanned
+	// a connection failed to authenticate with SASL
+	saslFailed *eventSASLFailed
 	// a connection died
 	dead *eventDead
 }
@@ -48,18 +62,64 @@ type eventNick struct {
 	nick string
 }
 
-// eventMessage is emitted when there is a PRIVMSG to the IRC channel. This
+// eventMessage is emitted when there is a PRIVMSG to an IRC channel. This
 // does not contain messages sent by ourselves, and messages are deduplicated
 // from multiple active IRC connections.
 type eventMessage struct {
 	conn    *ircconn
+	channel string
+	nick    string
+	message string
+	// whether the message is a CTCP ACTION (/me)
+	action bool
+	// IRCv3 message ID (msgid tag), if any
+	id string
+	// IRCv3 message ID of the message this one is a reply to, if any
+	replyTo string
+}
+
+// eventNotice is emitted when there is a NOTICE to an IRC channel, eg. from
+// ChanServ or other bots.
+type eventNotice struct {
+	conn    *ircconn
+	channel string
 	nick    string
 	message string
 }
 
+// eventTopic is emitted when someone changes the topic of an IRC channel.
+type eventTopic struct {
+	conn    *ircconn
+	channel string
+	nick    string
+	topic   string
+}
+
+// eventPresence is emitted when someone joins, parts, quits, gets kicked from
+// or changes nicks on an IRC channel.
+type eventPresence struct {
+	conn    *ircconn
+	channel string
+	kind    PresenceKind
+	// nick of the user that joined/left, or the kicker, or the old nick
+	nick string
+	// kicked nick or new nick, if applicable
+	target string
+	// part/quit/kick reason, if any
+	reason string
+}
+
 // eventBanned is amitted when a connection is banned from a channel.
 type eventBanned struct {
-	conn *ircconn
+	conn    *ircconn
+	channel string
+}
+
+// eventSASLFailed is emitted when a connection could not authenticate using
+// SASL.
+type eventSASLFailed struct {
+	conn   *ircconn
+	reason string
 }
 
 // eventDead is emitted when a connection has died and needs to be disposed of
@@ -67,11 +127,68 @@ type eventDead struct {
 	conn *ircconn
 }
 
-func (m *Manager) notifyAll(n *Notification) {
-	for s, _ := range m.subscribers {
-		go func(c chan *Notification, n *Notification) {
-			c <- n
-		}(s, n)
+// notify sends a notification to subscribers of a given channel, or to all
+// subscribers if channel is empty.
+func (m *Manager) notify(channel string, n *Notification) {
+	for _, s := range m.subscribers {
+		if channel != "" && s.channel != channel {
+			continue
+		}
+		s.push(n)
+	}
+}
+
+// subscriber is a Go channel subscribed to notifications about an IRC channel.
+// Notifications are queued and passed to the Go channel in order, without
+// blocking the Manager on a slow subscriber.
+type subscriber struct {
+	channel string
+	c       chan *Notification
+
+	queue []*Notification
+	qmu   sync.Mutex
+	qv    chan struct{}
+}
+
+func newSubscriber(channel string, c chan *Notification) *subscriber {
+	return &subscriber{
+		channel: channel,
+		c:       c,
+		qv:      make(chan struct{}, 1),
+	}
+}
+
+// push queues a notification to be passed to the subscriber.
+func (s *subscriber) push(n *Notification) {
+	s.qmu.Lock()
+	s.queue = append(s.queue, n)
+	s.qmu.Unlock()
+	select {
+	case s.qv <- struct{}{}:
+	default:
+	}
+}
+
+// forward passes queued notifications to the subscriber in order, until ctx
+// is done.
+func (s *subscriber) forward(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.qv:
+		}
+		s.qmu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.qmu.Unlock()
+		for _, n := range queue {
+			select {
+			case s.c <- n:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}
 }
 
@@ -105,15 +222,22 @@ func (m *Manager) doevent(ctx context.Context, e *event) {
 		for k, v := range m.nickmap {
 			nm[k] = v
 		}
-		m.notifyAll(&Notification{
+		m.notify("", &Notification{
 			Nickmap: &nm,
 		})
 
 	case e.banned != nil:
 		// A connection is banned. Shitlist the given user to not retry again.
 		user := e.banned.conn.user
-		glog.Infof("Event: %s is banned!", user)
-		m.shitlist[user] = time.Now().Add(time.Hour)
+		glog.Infof("Event: %s is banned from %s!", user, e.banned.channel)
+		m.shitlist[userChannel{user, e.banned.channel}] = time.Now().Add(time.Hour)
+
+	case e.saslFailed != nil:
+		// A connection could not authenticate. Fall back to connecting
+		// without SASL for this user for a while.
+		user := e.saslFailed.conn.user
+		glog.Errorf("Event: SASL failed for %s (%s), falling back to unauthenticated connections", user, e.saslFailed.reason)
+		m.saslFallback[user] = time.Now().Add(time.Hour)
 
 	case e.dead != nil:
 		// Dead update from connection.
@@ -131,7 +255,7 @@ func (m *Manager) doevent(ctx context.Context, e *event) {
 		// Route messages from receivers.
 
 		// Drop non-receiver events.
-		if !e.message.conn.receiver {
+		if !e.message.conn.receiver[e.message.channel] {
 			return
 		}
 
@@ -142,10 +266,74 @@ func (m *Manager) doevent(ctx context.Context, e *event) {
 			}
 		}
 
-		m.notifyAll(&Notification{
+		m.notify(e.message.channel, &Notification{
 			Message: &NotificationMessage{
 				Nick:    e.message.nick,
 				Message: e.message.message,
+				Action:  e.message.action,
+				ID:      e.message.id,
+				ReplyTo: e.message.replyTo,
+			},
+		})
+
+	case e.notice != nil:
+		// Route notices from receivers.
+
+		// Drop non-receiver events.
+		if !e.notice.conn.receiver[e.notice.channel] {
+			return
+		}
+
+		// Ensure this is not from us.
+		for _, i := range m.nickmap {
+			if e.notice.nick == i {
+				return
+			}
+		}
+
+		m.notify(e.notice.channel, &Notification{
+			Notice: &NotificationMessage{
+				Nick:    e.notice.nick,
+				Message: e.notice.message,
+			},
+		})
+
+	case e.topic != nil:
+		// Route topic changes from receivers.
+
+		// Drop non-receiver events.
+		if !e.topic.conn.receiver[e.topic.channel] {
+			return
+		}
+
+		m.notify(e.topic.channel, &Notification{
+			Topic: &NotificationTopic{
+				Nick:  e.topic.nick,
+				Topic: e.topic.topic,
+			},
+		})
+
+	case e.presence != nil:
+		// Route presence changes from receivers.
+
+		// Drop non-receiver events.
+		if !e.presence.conn.receiver[e.presence.channel] {
+			return
+		}
+
+		// Ensure this is not about us.
+		for _, i := range m.nickmap {
+			if e.presence.nick == i || ((e.presence.kind == PresenceNick || e.presence.kind == PresenceKick) && e.presence.target == i) {
+				return
+			}
+		}
+
+		m.notify(e.presence.channel, &Notification{
+			Presence: &NotificationPresence{
+				Kind:   e.presence.kind,
+				Nick:   e.presence.nick,
+				Target: e.presence.target,
+				Reason: e.presence.reason,
 			},
 		})
 
@@ -0,0 +1,550 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hakierspejs/lelelegram/irc/irctest"
+)
+
+const (
+	testChannel = "#test"
+	testTimeout = 5 * time.Second
+	// nick of the backup connection
+	testBackup = "lelebot[t]"
+)
+
+// newTestManager starts a fake IRC server, and a Manager for testChannel on it
+// allowing max connections. It returns the server, the Manager, and the
+// Manager's notifications about testChannel.
+func newTestManager(t *testing.T, max int, tags bool) (*irctest.Server, *Manager, chan *Notification) {
+	t.Helper()
+	s, err := irctest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	s.Tags = tags
+	t.Cleanup(s.Close)
+
+	m := NewManager(max, s.Addr, []string{testChannel}, "lelebot", "", "[t]", nil, nil, nil, RateLimit{}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go m.Run(ctx)
+	n := make(chan *Notification)
+	m.Subscribe(testChannel, n)
+	return s, m, n
+}
+
+// send sends a one line message to testChannel as a given user, and waits for
+// the server to get it.
+func send(t *testing.T, s *irctest.Server, m *Manager, user, text string) {
+	t.Helper()
+	n := len(s.Messages())
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := m.SendMessage(ctx, testChannel, user, text); err != nil {
+		t.Fatalf("SendMessage(%q, %q): %v", user, text, err)
+	}
+	if _, err := s.WaitMessages(n+1, testTimeout); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// receive waits for a message notification, skipping other notifications.
+func receive(t *testing.T, n chan *Notification) *NotificationMessage {
+	t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case no := <-n:
+			if no.Message != nil {
+				return no.Message
+			}
+		case <-deadline:
+			t.Fatalf("no message received from IRC")
+			return nil
+		}
+	}
+}
+
+// noMessage checks that no message notification comes in for a while.
+func noMessage(t *testing.T, n chan *Notification) {
+	t.Helper()
+	deadline := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case no := <-n:
+			if no.Message != nil {
+				t.Errorf("unexpected message %+v", no.Message)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// texts returns what nicks said in messages, as "nick: text".
+func texts(msgs []*irctest.Message) []string {
+	res := []string{}
+	for _, m := range msgs {
+		res = append(res, m.Nick+": "+m.Text)
+	}
+	return res
+}
+
+// said returns what a nick said in messages.
+func said(msgs []*irctest.Message, nick string) []string {
+	res := []string{}
+	for _, m := range msgs {
+		if m.Nick == nick {
+			res = append(res, m.Text)
+		}
+	}
+	return res
+}
+
+func TestManagerReceive(t *testing.T) {
+	s, _, n := newTestManager(t, 5, true)
+	if err := s.WaitMember(testChannel, testBackup, true, testTimeout); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	s.Say("alice", testChannel, "hello")
+	got := receive(t, n)
+	if got.Nick != "alice" || got.Message != "hello" {
+		t.Errorf("got %+v, want hello from alice", got)
+	}
+	if got.ID == "" {
+		t.Errorf("got no message ID")
+	}
+	s.Say("alice", testChannel, "\x01ACTION waves\x01")
+	got = receive(t, n)
+	if !got.Action || got.Message != "waves" {
+		t.Errorf("got %+v, want action waves", got)
+	}
+}
+
+func TestManagerSendOrder(t *testing.T) {
+	s, m, _ := newTestManager(t, 5, false)
+	sendMessage := func(user, text string) {
+		if err := m.SendMessage(context.Background(), testChannel, user, text); err != nil {
+			t.Fatalf("SendMessage(%q, %q): %v", user, text, err)
+		}
+	}
+
+	// Lines of a message, and messages of a user, arrive in order. Messages
+	// from different connections may overtake each other.
+	long := strings.Repeat("word ", 200)
+	sendMessage("bob", "one\ntwo")
+	sendMessage("carol", "three")
+	sendMessage("bob", long)
+	sendMessage("bob", "four")
+
+	split := splitText(long, lineBudget("bob[t]", "~bob@"+irctest.Host, testChannel, false))
+	if len(split) < 2 {
+		t.Fatalf("long message not split: %q", split)
+	}
+	want := append(append([]string{"one", "two"}, split...), "four")
+
+	msgs, err := s.WaitMessages(len(want)+1, testTimeout)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got := said(msgs, "bob[t]"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got messages %q from bob, want %q", got, want)
+	}
+	if got := said(msgs, "carol[t]"); fmt.Sprint(got) != "[three]" {
+		t.Errorf("got messages %q from carol, want three", got)
+	}
+}
+
+func TestManagerReceiveOrder(t *testing.T) {
+	s, _, n := newTestManager(t, 5, false)
+	if err := s.WaitMember(testChannel, testBackup, true, testTimeout); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	// Messages from IRC are passed to subscribers in the order they were
+	// said in.
+	for i := 0; i < 50; i++ {
+		s.Say("alice", testChannel, fmt.Sprint(i))
+	}
+	for i := 0; i < 50; i++ {
+		if got, want := receive(t, n).Message, fmt.Sprint(i); got != want {
+			t.Fatalf("got message %q, want %q", got, want)
+		}
+	}
+}
+
+func TestManagerSendAction(t *testing.T) {
+	s, m, _ := newTestManager(t, 5, false)
+
+	// Actions are sent as CTCP ACTIONs line by line, while messages starting
+	// with /me are sent as they are.
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := m.SendReply(ctx, testChannel, "bob", "waves\nsmiles", "", true); err != nil {
+		t.Fatalf("SendReply: %v", err)
+	}
+	if err := m.SendMessage(ctx, testChannel, "bob", "/me is literal"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	msgs, err := s.WaitMessages(3, testTimeout)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	want := []string{"\x01ACTION waves\x01", "\x01ACTION smiles\x01", "/me is literal"}
+	if got := said(msgs, "bob[t]"); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestManagerSendOrderFlood(t *testing.T) {
+	s, err := irctest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(s.Close)
+	m := NewManager(5, s.Addr, []string{testChannel}, "lelebot", "", "[t]", nil, nil, nil, RateLimit{Rate: 50, Burst: 2}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	// Messages sent concurrently by different users are all delivered, each
+	// user's in order, despite flood control queueing lines.
+	errs := make(chan error)
+	for _, user := range []string{"bob", "carol"} {
+		go func(user string) {
+			for i := 0; i < 5; i++ {
+				if err := m.SendMessage(ctx, testChannel, user, fmt.Sprintf("%d\n%d", 2*i, 2*i+1)); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(user)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+	}
+
+	msgs, err := s.WaitMessages(20, testTimeout)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	next := make(map[string]int)
+	for _, msg := range msgs {
+		if want := fmt.Sprint(next[msg.Nick]); msg.Text != want {
+			t.Errorf("got %q from %s, want %q", msg.Text, msg.Nick, want)
+		}
+		next[msg.Nick]++
+	}
+}
+
+func TestManagerServerFlood(t *testing.T) {
+	s, err := irctest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(s.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Managers for different nick suffixes on the same server share its
+	// flood control: 6 lines at a burst of 2 and 10 per second take at least
+	// 400ms.
+	flood := NewServerFlood(RateLimit{Rate: 10, Burst: 2})
+	start := time.Now()
+	errs := make(chan error)
+	for _, suffix := range []string{"[a]", "[b]"} {
+		m := NewManager(5, s.Addr, []string{testChannel}, "lelebot", "", suffix, nil, nil, nil, RateLimit{}, flood)
+		go m.Run(ctx)
+		go func() {
+			errs <- m.SendMessage(ctx, testChannel, "bob", "0\n1\n2")
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+	}
+	if _, err := s.WaitMessages(6, testTimeout); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Errorf("6 lines sent in %v, want at least 400ms", d)
+	}
+}
+
+func TestManagerSendTimeout(t *testing.T) {
+	s, err := irctest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(s.Close)
+	m := NewManager(5, s.Addr, []string{testChannel}, "lelebot", "", "[t]", nil, nil, nil, RateLimit{Rate: 10, Burst: 1}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+	send(t, s, m, "bob", "hi")
+
+	// A message that times out while being sent is sent in full.
+	errs := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+		defer cancel()
+		errs <- m.SendMessage(ctx, testChannel, "bob", "0\n1\n2\n3\n4\n5\n6\n7\n8\n9")
+	}()
+	if _, err := s.WaitMessages(2, testTimeout); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// One that times out while queued behind it is not sent at all.
+	ctxT, cancelT := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelT()
+	if err := m.SendMessage(ctxT, testChannel, "bob", "late"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("SendMessage(late): got %v, want ErrTimeout", err)
+	}
+	if err := <-errs; !errors.Is(err, ErrPartial) {
+		t.Errorf("SendMessage: got %v, want ErrPartial", err)
+	}
+	send(t, s, m, "bob", "bye")
+
+	msgs, err := s.WaitMessages(12, testTimeout)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	want := "hi 0 1 2 3 4 5 6 7 8 9 bye"
+	if got := strings.Join(said(msgs, "bob[t]"), " "); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestManagerReceiverFailover(t *testing.T) {
+	s, m, n := newTestManager(t, 5, false)
+	if err := s.WaitMember(testChannel, testBackup, true, testTimeout); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	// Once a named connection joined, the backup goes away, and the named
+	// connection becomes the receiver.
+	send(t, s, m, "bob", "hi")
+	if err := s.WaitMember(testChannel, testBackup, false, testTimeout); err != nil {
+		t.Fatalf("backup not evicted: %v", err)
+	}
+	s.Say("alice", testChannel, "one")
+	if got := receive(t, n); got.Message != "one" {
+		t.Errorf("got %q, want one", got.Message)
+	}
+	noMessage(t, n)
+
+	// When the receiver disconnects, the backup comes back.
+	if err := s.Disconnect("bob[t]"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := s.WaitMember(testChannel, testBackup, true, testTimeout); err != nil {
+		t.Fatalf("backup not restored: %v", err)
+	}
+	s.Say("alice", testChannel, "two")
+	if got := receive(t, n); got.Message != "two" {
+		t.Errorf("got %q, want two", got.Message)
+	}
+	noMessage(t, n)
+}
+
+func TestManagerKicked(t *testing.T) {
+	s, m, _ := newTestManager(t, 5, false)
+
+	send(t, s, m, "bob", "one")
+	if err := s.Kick(testChannel, "bob[t]", "go away"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// Being kicked from its only channel kills the connection, and the next
+	// message gets a new one.
+	if err := s.WaitConnected("bob[t]", false, testTimeout); err != nil {
+		t.Fatalf("%v", err)
+	}
+	send(t, s, m, "bob", "two")
+
+	msgs, err := s.WaitMessages(2, testTimeout)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got, want := fmt.Sprint(texts(msgs)), "[bob[t]: one bob[t]: two]"; got != want {
+		t.Errorf("got messages %s, want %s", got, want)
+	}
+}
+
+func TestManagerPresenceOfOurs(t *testing.T) {
+	m := NewManager(5, "", []string{testChannel}, "lelebot", "", "[t]", nil, nil, nil, RateLimit{}, nil)
+	m.nickmap = map[string]string{"bob": "bob[t]"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := make(chan *Notification)
+	m.subscribers = make(map[chan *Notification]*subscriber)
+	m.doctrl(ctx, &control{subscribe: &controlSubscribe{testChannel, n}})
+	conn := &ircconn{receiver: map[string]bool{testChannel: true}}
+
+	// Presence changes of our own connections are not relayed.
+	for _, p := range []*eventPresence{
+		{conn, testChannel, PresenceKick, "op", "bob[t]", "go away"},
+		{conn, testChannel, PresencePart, "bob[t]", "", ""},
+		{conn, testChannel, PresenceNick, "bob", "bob[t]", ""},
+	} {
+		m.doevent(context.Background(), &event{presence: p})
+	}
+	m.doevent(context.Background(), &event{presence: &eventPresence{conn, testChannel, PresenceKick, "op", "alice", "bye"}})
+	select {
+	case no := <-n:
+		if p := no.Presence; p == nil || p.Kind != PresenceKick || p.Target != "alice" {
+			t.Errorf("got %+v, want kick of alice", no.Presence)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("kick of alice not relayed")
+	}
+	select {
+	case no := <-n:
+		t.Errorf("got %+v, want nothing else", no.Presence)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestManagerSASLIgnored(t *testing.T) {
+	s, err := irctest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	s.NoCap = true
+	t.Cleanup(s.Close)
+	sasl := &SASLCredentials{Mechanism: "PLAIN", Login: "lelebot", Password: "hunter2"}
+	m := NewManager(5, s.Addr, []string{testChannel}, "lelebot", "", "[t]", nil, sasl, nil, RateLimit{}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	// A server that registers us without SASL counts as SASL failing, and
+	// the backup connection falls back to connecting without it. The server
+	// might not have noticed the first connection go yet, so the backup can
+	// come back under an alternative nick.
+	deadline := time.Now().Add(testTimeout)
+	for len(s.Members(testChannel)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("backup did not join %s", testChannel)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManagerBanned(t *testing.T) {
+	s, m, _ := newTestManager(t, 5, false)
+	s.Ban(testChannel, "carol")
+
+	for i := 0; i < 2; i++ {
+		err := m.SendMessage(context.Background(), testChannel, "carol", "hi")
+		if !errors.Is(err, ErrBanned) {
+			t.Errorf("got error %v, want %v", err, ErrBanned)
+		}
+	}
+	send(t, s, m, "bob", "hi")
+	if got := texts(s.Messages()); fmt.Sprint(got) != "[bob[t]: hi]" {
+		t.Errorf("got messages %q, want only bob's", got)
+	}
+}
+
+func TestManagerNickInUse(t *testing.T) {
+	s, m, n := newTestManager(t, 5, false)
+	s.Reserve("bob[t]")
+
+	send(t, s, m, "bob", "hi")
+	msgs := s.Messages()
+	if len(msgs) != 1 || msgs[0].Nick != "bob1[t]" {
+		t.Fatalf("got messages %q, want one from bob1[t]", texts(msgs))
+	}
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case no := <-n:
+			if no.Nickmap != nil && (*no.Nickmap)["bob"] == "bob1[t]" {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no nickmap with bob1[t]")
+		}
+	}
+}
+
+func TestManagerNickChanges(t *testing.T) {
+	s, m, n := newTestManager(t, 5, false)
+	send(t, s, m, "bob", "hi")
+	if err := s.WaitMember(testChannel, testBackup, false, testTimeout); err != nil {
+		t.Fatalf("backup not evicted: %v", err)
+	}
+
+	// Quick nick changes reach the Manager in order, so that it knows bob's
+	// last nick, and doesn't relay what it says.
+	if err := s.Rename("bob[t]", "bob1[t]"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := s.Rename("bob1[t]", "bob2[t]"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	s.Say("bob2[t]", testChannel, "echo")
+	s.Say("alice", testChannel, "hello")
+	if got := receive(t, n); got.Nick != "alice" || got.Message != "hello" {
+		t.Errorf("got %q from %s, want hello from alice", got.Message, got.Nick)
+	}
+}
+
+func TestManagerNickRefused(t *testing.T) {
+	s, m, _ := newTestManager(t, 5, false)
+	send(t, s, m, "bob", "hi")
+
+	// A refused nick change after registering leaves the nick as it is.
+	for _, c := range []string{"432", "433", "437"} {
+		if err := s.Reply("bob[t]", c, "bob", "Nickname is unavailable"); err != nil {
+			t.Fatalf("Reply: %v", err)
+		}
+	}
+	send(t, s, m, "bob", "still here")
+	if got, want := strings.Join(said(s.Messages(), "bob[t]"), "|"), "hi|still here"; got != want {
+		t.Errorf("bob[t] said %q, want %q", got, want)
+	}
+}
+
+func TestManagerEvictLRU(t *testing.T) {
+	s, m, _ := newTestManager(t, 2, false)
+	if err := s.WaitMember(testChannel, testBackup, true, testTimeout); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	send(t, s, m, "bob", "one")
+	if err := s.WaitMember(testChannel, testBackup, false, testTimeout); err != nil {
+		t.Fatalf("backup not evicted: %v", err)
+	}
+	send(t, s, m, "carol", "two")
+	// Over the limit, the least recently used connection (bob's) goes.
+	send(t, s, m, "dave", "three")
+	if err := s.WaitConnected("bob[t]", false, testTimeout); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := s.WaitConnected("carol[t]", true, testTimeout); err != nil {
+		t.Fatalf("%v", err)
+	}
+	send(t, s, m, "bob", "four")
+	if err := s.WaitConnected("carol[t]", false, testTimeout); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	msgs, err := s.WaitMessages(4, testTimeout)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got, want := fmt.Sprint(texts(msgs)), "[bob[t]: one carol[t]: two dave[t]: three bob[t]: four]"; got != want {
+		t.Errorf("got messages %s, want %s", got, want)
+	}
+}
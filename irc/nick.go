@@ -0,0 +1,91 @@
+package irc
+
+import (
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// RFC standard - 9. Freenode allows 16 chars for nickname
+const maxIRCNick = 16
+
+var reIRCNick = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// ircUsername generates an IRC username from a Telegram username.
+func ircUsername(userTelegram string) string {
+	username := reIRCNick.ReplaceAllString(userTelegram, "")
+	if len(username) > 9 {
+		username = username[:9]
+	}
+	return username
+}
+
+// ircNicks generates IRC nicks for a Telegram username. The first nick is the
+// preferred one, and the following are deterministic alternatives to try (in
+// order) if the preferred nick is already in use: numeric suffixes, a suffix
+// derived from a hash of the Telegram username, and truncated variants.
+// All nicks keep the given prefix and suffix and fit in maxIRCNick chars.
+func ircNicks(userTelegram, prefix, suffix string) []string {
+	core := strings.ToLower(reIRCNick.ReplaceAllString(userTelegram, ""))
+	if len(core) == 0 {
+		glog.Errorf("Could not create IRC nick for %q", userTelegram)
+		core = "wtf"
+	}
+	nickLen := maxIRCNick - len(prefix) - len(suffix)
+	if nickLen < 1 {
+		nickLen = 1
+	}
+
+	// mk builds a nick from the core truncated to fit alongside extra.
+	mk := func(extra string) string {
+		n := nickLen - len(extra)
+		if n < 1 {
+			n = 1
+		}
+		c := core
+		if len(c) > n {
+			c = c[:n]
+		}
+		return prefix + c + extra + suffix
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(userTelegram))
+	hash := strconv.FormatUint(uint64(h.Sum32()), 36)
+
+	candidates := []string{mk("")}
+	for i := 1; i <= 9; i++ {
+		candidates = append(candidates, mk(strconv.Itoa(i)))
+	}
+	if len(hash) > 3 {
+		candidates = append(candidates, mk(hash[:3]))
+	}
+	candidates = append(candidates, mk(hash))
+	fit := core
+	if len(fit) > nickLen {
+		fit = fit[:nickLen]
+	}
+	for i := len(fit) - 1; i > 0 && i >= len(fit)-3; i-- {
+		candidates = append(candidates, prefix+fit[:i]+suffix)
+	}
+
+	// Deduplicate, keeping order.
+	seen := make(map[string]bool)
+	res := []string{}
+	for _, c := range candidates {
+		if len(c) > maxIRCNick || seen[c] {
+			continue
+		}
+		seen[c] = true
+		res = append(res, c)
+	}
+	if len(res) == 0 {
+		// Prefix and suffix are too long for anything sensible, just try
+		// the preferred nick anyway.
+		res = append(res, candidates[0])
+	}
+	return res
+}
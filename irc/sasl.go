@@ -0,0 +1,87 @@
+package irc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// SASLCredentials are used to authenticate a connection to IRC using SASL.
+type SASLCredentials struct {
+	// Mechanism is the SASL mechanism to use, either PLAIN or EXTERNAL. The
+	// EXTERNAL mechanism uses the TLS client certificate of the connection.
+	Mechanism string `json:"mechanism"`
+	// Login is the account name for the PLAIN mechanism.
+	Login string `json:"login"`
+	// Password is the account password for the PLAIN mechanism.
+	Password string `json:"password"`
+}
+
+// Validate checks whether the credentials are usable.
+func (s *SASLCredentials) Validate() error {
+	switch strings.ToUpper(s.Mechanism) {
+	case "PLAIN":
+		if s.Login == "" || s.Password == "" {
+			return fmt.Errorf("PLAIN needs a login and password")
+		}
+	case "EXTERNAL":
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q", s.Mechanism)
+	}
+	return nil
+}
+
+// External returns whether the credentials use the EXTERNAL mechanism, ie.
+// need a TLS client certificate.
+func (s *SASLCredentials) External() bool {
+	return strings.ToUpper(s.Mechanism) == "EXTERNAL"
+}
+
+// payload returns the AUTHENTICATE payload lines for the credentials,
+// base64-encoded and split into 400 byte chunks as per the IRCv3 SASL spec.
+func (s *SASLCredentials) payload() []string {
+	if s.External() {
+		return []string{"+"}
+	}
+	raw := s.Login + "\x00" + s.Login + "\x00" + s.Password
+	enc := base64.StdEncoding.EncodeToString([]byte(raw))
+	res := []string{}
+	for len(enc) >= 400 {
+		res = append(res, enc[:400])
+		enc = enc[400:]
+	}
+	if enc == "" {
+		// Payload was a multiple of 400 bytes, terminate it explicitly.
+		enc = "+"
+	}
+	return append(res, enc)
+}
+
+// CredentialStore maps Telegram user names to their SASL credentials.
+type CredentialStore map[string]*SASLCredentials
+
+// LoadCredentialStore reads a CredentialStore from a JSON file, eg.:
+//
+//	{"q3k": {"mechanism": "PLAIN", "login": "q3k", "password": "hunter2"}}
+func LoadCredentialStore(path string) (CredentialStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cs CredentialStore
+	if err := json.Unmarshal(data, &cs); err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", path, err)
+	}
+	for u, c := range cs {
+		if c == nil {
+			delete(cs, u)
+			continue
+		}
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("credentials for %q: %v", u, err)
+		}
+	}
+	return cs, nil
+}
@@ -0,0 +1,238 @@
+package irc
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// maxLine is the maximum length of an IRC line, including the trailing CRLF
+// (RFC 1459, section 2.3).
+const maxLine = 512
+
+// maxHost is the length of the hostname assumed for our own connection until
+// the server tells us what it is.
+const maxHost = 63
+
+// lineBudget returns how many bytes of text fit in a PRIVMSG to a channel, as
+// relayed by the server to other clients, ie. prefixed by our nick!user@host.
+func lineBudget(nick, userhost, channel string, action bool) int {
+	b := maxLine - len("\r\n") - len(":"+nick+"!"+userhost+" PRIVMSG "+channel+" :")
+	if action {
+		b -= len(ctcpAction(""))
+	}
+	return b
+}
+
+// splitText splits text into lines of at most budget bytes. Text is split at
+// newlines first, and then long lines are split at the last whitespace that
+// fits, or between grapheme clusters if there is none. Runes and colour codes
+// are never split. As every line sent to IRC starts unformatted, the
+// formatting in effect where a line was split is restored at the beginning of
+// the next one. Empty lines are dropped.
+func splitText(text string, budget int) []string {
+	res := []string{}
+	f := formatState{}
+	for _, l := range strings.Split(text, "\n") {
+		l = strings.TrimSpace(l)
+		for l != "" {
+			prefix := f.codes(l)
+			part, rest := splitLine(l, budget-len(prefix))
+			if len(prefix)+len(part) > budget {
+				// Not even the first grapheme cluster fits after the
+				// restored formatting: drop it rather than go over budget.
+				prefix = ""
+				part, rest = splitLine(l, budget)
+			}
+			l = rest
+			f.update(part)
+			// Parts of just formatting codes (eg. at the end of a line) are
+			// not worth a line of their own.
+			if part = strings.TrimSpace(part); strings.TrimSpace(StripFormatting(part)) != "" {
+				res = append(res, prefix+part)
+			}
+			l = strings.TrimSpace(l)
+		}
+	}
+	return res
+}
+
+// splitLine splits a line into a first part of at most budget bytes, and the
+// rest. The first part holds some text, and not just formatting codes, unless
+// the codes before the first text are over budget themselves.
+func splitLine(line string, budget int) (string, string) {
+	if len(line) <= budget {
+		return line, ""
+	}
+	inCode := colourCodes(line)
+
+	// Find the last whitespace and grapheme cluster boundary that fit, after
+	// the first text.
+	text := false
+	cut, spaceFrom, spaceTo := 0, 0, 0
+	g := uniseg.NewGraphemes(line)
+	for g.Next() {
+		from, to := g.Positions()
+		if to > budget {
+			break
+		}
+		r, _ := utf8.DecodeRuneInString(line[from:to])
+		if unicode.IsSpace(r) && text {
+			spaceFrom, spaceTo = from, to
+		}
+		if !inCode[from] && !isFormatCode(line[from]) && !unicode.IsSpace(r) {
+			text = true
+		}
+		if inCode[to] || !text {
+			continue
+		}
+		cut = to
+	}
+	switch {
+	case spaceFrom > 0:
+		return line[:spaceFrom], line[spaceTo:]
+	case cut > 0:
+		return line[:cut], line[cut:]
+	}
+
+	// The first text is over budget - split it between runes, but always
+	// make progress. This might only split off the formatting codes before
+	// it, which the caller restores more compactly.
+	cut = 0
+	for cut < len(line) {
+		_, size := utf8.DecodeRuneInString(line[cut:])
+		if cut > 0 && !inCode[cut] && cut+size > budget {
+			break
+		}
+		cut += size
+	}
+	return line[:cut], line[cut:]
+}
+
+// colourCodes returns which byte offsets of a line are within a colour code,
+// ie. between its control character and the end of its parameters, where the
+// line must not be split.
+func colourCodes(line string) []bool {
+	in := make([]bool, len(line)+1)
+	for i := 0; i < len(line); i++ {
+		n := 0
+		switch line[i] {
+		case '\x03':
+			n = colourLen(line[i+1:], isDigit, 2)
+		case '\x04':
+			n = colourLen(line[i+1:], isHex, 6)
+		}
+		for j := i + 1; j <= i+n; j++ {
+			in[j] = true
+		}
+		i += n
+	}
+	return in
+}
+
+// isFormatCode returns whether c is the control character of a mIRC
+// formatting code.
+func isFormatCode(c byte) bool {
+	return strings.IndexByte("\x02\x1d\x1f\x1e\x11\x16\x0f\x03\x04", c) >= 0
+}
+
+// formatState is the mIRC formatting in effect at some point of a message.
+type formatState struct {
+	Style
+	reverse bool
+	// foreground and background colour parameters of the last colour (\x03)
+	// and hex colour (\x04) codes, empty if unset
+	fg, bg       string
+	hexFg, hexBg string
+}
+
+// update changes the formatting state by the codes in text.
+func (f *formatState) update(text string) {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\x02':
+			f.Bold = !f.Bold
+		case '\x1d':
+			f.Italic = !f.Italic
+		case '\x1f':
+			f.Underline = !f.Underline
+		case '\x1e':
+			f.Strikethrough = !f.Strikethrough
+		case '\x11':
+			f.Monospace = !f.Monospace
+		case '\x16':
+			f.reverse = !f.reverse
+		case '\x0f':
+			*f = formatState{}
+		case '\x03':
+			n := colourLen(text[i+1:], isDigit, 2)
+			f.fg, f.bg = colourParams(text[i+1:i+1+n], f.bg)
+			i += n
+		case '\x04':
+			n := colourLen(text[i+1:], isHex, 6)
+			f.hexFg, f.hexBg = colourParams(text[i+1:i+1+n], f.hexBg)
+			i += n
+		}
+	}
+}
+
+// colourParams returns the foreground and background of colour code
+// parameters. A code without parameters resets both, and one without a
+// background keeps the previous one, bg.
+func colourParams(params, bg string) (string, string) {
+	if params == "" {
+		return "", ""
+	}
+	p := strings.SplitN(params, ",", 2)
+	if len(p) == 2 {
+		return p[0], p[1]
+	}
+	return p[0], bg
+}
+
+// codes returns the formatting codes that restore the formatting state at the
+// beginning of a line continuing with text.
+func (f *formatState) codes(text string) string {
+	var b strings.Builder
+	for _, c := range []struct {
+		on   bool
+		code string
+	}{
+		{f.Bold, "\x02"}, {f.Italic, "\x1d"}, {f.Underline, "\x1f"},
+		{f.Strikethrough, "\x1e"}, {f.Monospace, "\x11"}, {f.reverse, "\x16"},
+	} {
+		if c.on {
+			b.WriteString(c.code)
+		}
+	}
+	if f.fg != "" {
+		// Colours are padded to two digits, so that digits at the beginning
+		// of text are not taken as part of them.
+		b.WriteString("\x03" + padColour(f.fg))
+		if f.bg != "" {
+			b.WriteString("," + padColour(f.bg))
+		}
+	}
+	if f.hexFg != "" {
+		b.WriteString("\x04" + f.hexFg)
+		if f.hexBg != "" {
+			b.WriteString("," + f.hexBg)
+		}
+	}
+	// Neither should a comma at the beginning of text be taken as starting
+	// a background colour.
+	if (f.fg != "" || f.hexFg != "") && strings.HasPrefix(text, ",") {
+		b.WriteString("\x02\x02")
+	}
+	return b.String()
+}
+
+// padColour pads a colour number to two digits.
+func padColour(c string) string {
+	if len(c) == 1 {
+		return "0" + c
+	}
+	return c
+}
@@ -0,0 +1,98 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitText(t *testing.T) {
+	for _, test := range []struct {
+		text   string
+		budget int
+		want   []string
+	}{
+		{"zażółć gęślą jaźń", 10, []string{"zażółć", "gęślą", "jaźń"}},
+		{"a\n\n  b  \n", 10, []string{"a", "b"}},
+		// Without whitespace, lines are split between grapheme clusters.
+		{strings.Repeat("a", 25), 10, []string{strings.Repeat("a", 10), strings.Repeat("a", 10), "aaaaa"}},
+		{"żżżżż", 3, []string{"ż", "ż", "ż", "ż", "ż"}},
+		{"👍👍👍", 5, []string{"👍", "👍", "👍"}},
+		{"e\u0301e\u0301", 4, []string{"e\u0301", "e\u0301"}},
+		{"👨\u200d👩\u200d👧👨\u200d👩\u200d👧", 20, []string{"👨\u200d👩\u200d👧", "👨\u200d👩\u200d👧"}},
+		// Grapheme clusters over budget are split between runes.
+		{"👨\u200d👩\u200d👧", 8, []string{"👨\u200d", "👩\u200d", "👧"}},
+	} {
+		if got := splitText(test.text, test.budget); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitText(%q, %d) = %q, want %q", test.text, test.budget, got, test.want)
+		}
+	}
+}
+
+func TestSplitTextLong(t *testing.T) {
+	budget := lineBudget("alice[t]", "~alice@2a01-110-8012-1010.example.net", "#hakierspejs", false)
+	for _, text := range []string{
+		strings.Repeat("zażółć gęślą jaźń ", 100),
+		strings.Repeat("ż", 1000),
+		strings.Repeat("a👍", 500),
+		strings.Repeat("👨\u200d👩\u200d👧", 100),
+	} {
+		lines := splitText(text, budget)
+		if len(lines) < 2 {
+			t.Errorf("%.20q...: not split", text)
+		}
+		for _, l := range lines {
+			if len(l) > budget || !utf8.ValidString(l) {
+				t.Errorf("%.20q...: got line %q of %d bytes, want valid UTF-8 of at most %d", text, l, len(l), budget)
+			}
+		}
+		if got, want := strings.Join(lines, ""), strings.ReplaceAll(text, " ", ""); strings.ReplaceAll(got, " ", "") != want {
+			t.Errorf("%.20q...: text changed", text)
+		}
+	}
+}
+
+func TestLineBudget(t *testing.T) {
+	// ":alice[t]!~alice@2a01-110-8012-1010.example.net PRIVMSG #hakierspejs :"
+	// takes 70 bytes of a 512 byte line, CRLF 2 more, and the CTCP framing of
+	// actions another 9.
+	for _, test := range []struct {
+		action bool
+		want   int
+	}{
+		{false, 440},
+		{true, 431},
+	} {
+		if got := lineBudget("alice[t]", "~alice@2a01-110-8012-1010.example.net", "#hakierspejs", test.action); got != test.want {
+			t.Errorf("lineBudget(action: %v) = %d, want %d", test.action, got, test.want)
+		}
+	}
+}
+
+func TestSplitTextFormatting(t *testing.T) {
+	for _, test := range []struct {
+		text   string
+		budget int
+		want   []string
+	}{
+		{"hello world", 5, []string{"hello", "world"}},
+		{"\x02bold text here", 10, []string{"\x02bold", "\x02text here"}},
+		{"\x02a\x0f b c", 4, []string{"\x02a\x0f", "b c"}},
+		{"\x02a\nb", 100, []string{"\x02a", "\x02b"}},
+		// Colour codes are not split, and are padded when restored.
+		{"ab\x0304cd", 4, []string{"ab", "\x0304c", "\x0304d"}},
+		{"\x034,2red blue", 10, []string{"\x034,2red", "\x0304,02blue"}},
+		{"\x035xxxxxxx ,yy", 10, []string{"\x035xxxxxxx", "\x0305\x02\x02,yy"}},
+		{"\x04ff0000red blue", 11, []string{"\x04ff0000red", "\x04ff0000blue"}},
+		// Formatting is dropped rather than going over budget, and lines of
+		// just formatting codes are dropped.
+		{"\x0304,12abcdef", 6, []string{"abcdef"}},
+		{"\x02ab\x0304,12\x1dcd", 4, []string{"\x02ab", "\x1dcd"}},
+		{"a \x02\x0f", 3, []string{"a"}},
+	} {
+		if got := splitText(test.text, test.budget); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitText(%q, %d) = %q, want %q", test.text, test.budget, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+// Files of JSON values, one per line, back the message store and spools. They
+// are appended to as things change, and rewritten with just the values that
+// are still needed (compacted) once in a while.
+
+// readJSONLines calls decode with every line of the file at path, skipping
+// lines it fails to decode. A missing file is read as an empty one. what
+// describes the values in logs.
+func readJSONLines(path, what string, decode func(line []byte) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if err := decode(scanner.Bytes()); err != nil {
+			glog.Warningf("Skipping corrupted %s %q: %v", what, scanner.Text(), err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %q: %v", path, err)
+	}
+	return nil
+}
+
+// rewriteJSONLines atomically replaces the file at path with n values, the
+// i-th being value(i), and returns it opened for appending more.
+func rewriteJSONLines(path string, n int, value func(i int) interface{}) (*os.File, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := 0; i < n; i++ {
+		if err := enc.Encode(value(i)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+}
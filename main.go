@@ -2,10 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"strconv"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
@@ -19,6 +31,7 @@ func init() {
 }
 
 var (
+	flagConfig            string
 	flagTelegramToken     string
 	flagTelegramChat      string
 	flagTeleimgRoot       string
@@ -28,14 +41,73 @@ var (
 	flagIRCLogin          string
 	flagNickPrefix        string
 	flagNickSuffix        string
+	flagIRCTLS            bool
+	flagIRCTLSCA          string
+	flagIRCTLSServerName  string
+	flagIRCTLSCert        string
+	flagIRCTLSKey         string
+	flagIRCSASLMechanism  string
+	flagIRCSASLLogin      string
+	flagIRCSASLPassword   string
+	flagIRCSASLUsers      string
+	flagIRCPresence       bool
+	flagIRCPresenceDelay  time.Duration
+	flagIRCTopic          bool
+	flagIRCTopicDesc      bool
+	flagMessageStore      string
+	flagMessageStoreSize  int
+	flagTelegramEdits     string
+	flagSpoolDir          string
+	flagSpoolMaxAge       time.Duration
+	flagIRCFloodRate      float64
+	flagIRCFloodBurst     int
+	flagIRCServerRate     float64
+	flagIRCServerBurst    int
+	flagMetricsListen     string
+	flagIRCPlain          bool
+	flagIRCMarkup         bool
+	flagIRCUpload         bool
+	flagIRCUploadMaxSize  int64
+
+	flagTelegramAPIEndpoint   string
+	flagTelegramWebhookURL    string
+	flagTelegramWebhookListen string
+	flagTelegramWebhookSecret string
+	flagTelegramWebhookCert   string
+	flagTelegramWebhookKey    string
+
+	flagMediaListen      string
+	flagMediaURL         string
+	flagMediaSecret      string
+	flagMediaCacheDir    string
+	flagMediaCacheSize   int64
+	flagMediaCacheMaxAge time.Duration
 )
 
 // server is responsible for briding IRC and Telegram.
 type server struct {
 	// groupId is the Telegram Group ID to bridge.
 	groupId int64
+	// channel is the IRC channel to bridge.
+	channel string
 	tel     *tgbotapi.BotAPI
 	mgr     *irc.Manager
+	// msgs maps Telegram messages to their IRC origins
+	msgs *messageStore
+	// toIRC and toTelegram are spools of messages to deliver to IRC and
+	// Telegram
+	toIRC      *spool
+	toTelegram *spool
+	// media links media posted on Telegram for IRC
+	media mediaLinker
+	// ircPlain disables IRC formatting codes in messages from Telegram
+	ircPlain bool
+	// ircMarkup enables rendering of inline markup typed by IRC users
+	ircMarkup bool
+	// ircUpload enables uploading media linked on IRC to Telegram, downloaded
+	// with uploadClient
+	ircUpload    bool
+	uploadClient *http.Client
 
 	// backlog from telegram
 	telLog chan *telegramPlain
@@ -50,125 +122,411 @@ type telegramPlain struct {
 	user string
 	// Plain text of message, possibly multiline.
 	text string
+	// Text of the Telegram message itself, as kept in the message store.
+	source string
+	// Telegram message ID.
+	messageID int
+	// IRCv3 message ID of the IRC message this is a reply to, if any.
+	replyTo string
+	// Whether the message is a /me action, with text being the action.
+	action bool
+	// ID of the album the message is part of, if any, and the message without
+	// reply quote and forward attribution, on one line.
+	mediaGroup string
+	body       string
 }
 
-func newServer(groupId int64, mgr *irc.Manager) (*server, error) {
-	tel, err := tgbotapi.NewBotAPI(flagTelegramToken)
-	if err != nil {
-		return nil, fmt.Errorf("when creating telegram bot: %v", err)
-	}
+// ircOutbound is a message spooled for delivery to IRC.
+type ircOutbound struct {
+	// Telegram name that sent message - without '@'.
+	User string `json:"user"`
+	// Plain text of message, possibly multiline, with nicks translated.
+	Text string `json:"text"`
+	// IRCv3 message ID of the IRC message this is a reply to, if any.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Whether to send the message as a CTCP ACTION (/me).
+	Action bool `json:"action,omitempty"`
+}
 
-	glog.Infof("Authorized with Telegram as %q", tel.Self.UserName)
+// telegramOutbound is a message spooled for delivery to Telegram.
+type telegramOutbound struct {
+	// HTML text of message. If empty, only Plain is sent.
+	HTML string `json:"html,omitempty"`
+	// Plain text of message, sent if HTML fails.
+	Plain string `json:"plain"`
+	// Telegram message ID this is a reply to, if any.
+	ReplyTo int `json:"reply_to,omitempty"`
+	// Media to upload instead of sending the text, if any. The text is sent
+	// if the upload fails.
+	Upload *telegramUpload `json:"upload,omitempty"`
+	// Entry to record in the message store once sent, if any.
+	Entry *messageEntry `json:"entry,omitempty"`
+	// Correction is set for s/old/new/ corrections from IRC, which are
+	// applied by editing the corrected message (rendered with Nickmap) if
+	// it is known by then, and sent like other messages otherwise.
+	Correction bool              `json:"correction,omitempty"`
+	Nickmap    map[string]string `json:"nickmap,omitempty"`
+}
 
+func newServer(c *bridgeConfig, tel *tgbotapi.BotAPI, mgr *irc.Manager, msgs *messageStore, toIRC, toTelegram *spool) *server {
 	return &server{
-		groupId: groupId,
-		tel:     tel,
-		mgr:     mgr,
+		groupId:    c.TelegramChat,
+		channel:    c.IRCChannel,
+		tel:        tel,
+		mgr:        mgr,
+		msgs:       msgs,
+		toIRC:      toIRC,
+		toTelegram: toTelegram,
+		media:      teleimg(c.TeleimgRoot),
+		ircPlain:   *c.IRCPlain,
+		ircMarkup:  *c.IRCMarkup,
+		ircUpload:  *c.IRCUpload,
+
+		uploadClient: newUploadClient(),
 
-		telLog: make(chan *telegramPlain),
+		// Buffered, so that a bridge busy delivering to IRC does not stall
+		// the Telegram connection shared with other bridges.
+		telLog: make(chan *telegramPlain, 64),
 		ircLog: make(chan *irc.Notification),
-	}, nil
+	}
 }
 
 func main() {
+	flag.StringVar(&flagConfig, "config", "", "Path to YAML configuration file with bridges to run. Bridge settings not given in the file default to their flags (message_store and spool_dir to per-bridge paths derived from their flags)")
 	flag.StringVar(&flagTelegramToken, "telegram_token", "", "Telegram Bot API Token")
 	flag.StringVar(&flagTelegramChat, "telegram_chat", "", "Telegram chat/group ID to bridge. If not given, bridge will start in lame mode and allow you to find out IDs of groups which the bridge bot is part of")
-	flag.StringVar(&flagTeleimgRoot, "teleimg_root", "https://teleimg.hswaw.net/fileid/", "Root URL of teleimg file serving URL")
+	flag.StringVar(&flagTeleimgRoot, "teleimg_root", "https://teleimg.hswaw.net/fileid/", "Root URL of teleimg file serving URL, used to link media unless media_listen is given")
 	flag.IntVar(&flagIRCMaxConnections, "irc_max_connections", 10, "How many simulataneous connections can there be to IRC before they get recycled")
 	flag.StringVar(&flagIRCServer, "irc_server", "chat.freenode.net:6667", "The address (with port) of the IRC server to connect to")
 	flag.StringVar(&flagIRCChannel, "irc_channel", "", "The channel name (including hash(es)) to bridge")
 	flag.StringVar(&flagIRCLogin, "irc_login", "lelegram[t]", "The login of irc user used by bot")
 	flag.StringVar(&flagNickPrefix, "nick_prefix", "", "Prefix for nicks used on irc channel")
 	flag.StringVar(&flagNickSuffix, "nick_suffix", "[t]", "Sufix for nicks used on irc channel")
+	flag.BoolVar(&flagIRCTLS, "irc_tls", false, "Connect to IRC over TLS")
+	flag.StringVar(&flagIRCTLSCA, "irc_tls_ca", "", "Path to PEM CA bundle used to verify the IRC server certificate. If not given, system roots are used")
+	flag.StringVar(&flagIRCTLSServerName, "irc_tls_server_name", "", "Server name to verify the IRC server certificate against. If not given, the host part of irc_server is used")
+	flag.StringVar(&flagIRCTLSCert, "irc_tls_cert", "", "Path to PEM client certificate presented to the IRC server")
+	flag.StringVar(&flagIRCTLSKey, "irc_tls_key", "", "Path to PEM private key of irc_tls_cert")
+	flag.StringVar(&flagIRCSASLMechanism, "irc_sasl_mechanism", "", "SASL mechanism (PLAIN or EXTERNAL) used by the irc_login connection. If not given, SASL is not used")
+	flag.StringVar(&flagIRCSASLLogin, "irc_sasl_login", "", "SASL PLAIN account name of the irc_login connection")
+	flag.StringVar(&flagIRCSASLPassword, "irc_sasl_password", "", "SASL PLAIN password of the irc_login connection")
+	flag.StringVar(&flagIRCSASLUsers, "irc_sasl_users", "", "Path to JSON file mapping Telegram user names to SASL credentials of their IRC connections")
+	flag.BoolVar(&flagIRCPresence, "irc_presence", false, "Relay joins, parts, quits, kicks and nick changes on IRC to Telegram")
+	flag.DurationVar(&flagIRCPresenceDelay, "irc_presence_delay", 5*time.Second, "How long to collect IRC presence changes before sending them to Telegram as one message")
+	flag.BoolVar(&flagIRCTopic, "irc_topic", false, "Relay IRC topic changes to Telegram")
+	flag.BoolVar(&flagIRCTopicDesc, "irc_topic_description", false, "Set the Telegram group description to the IRC topic when it changes")
+	flag.StringVar(&flagMessageStore, "message_store", "", "Path to file storing the mapping between Telegram and IRC messages, used for replies. If not given, the mapping is kept in memory")
+	flag.IntVar(&flagMessageStoreSize, "message_store_size", 10000, "How many messages to keep in the message store")
+	flag.StringVar(&flagSpoolDir, "spool_dir", "", "Path to directory keeping messages waiting to be delivered to IRC and Telegram, so that they survive restarts. If not given, they are kept in memory")
+	flag.DurationVar(&flagSpoolMaxAge, "spool_max_age", 24*time.Hour, "How long to keep retrying delivery of a message before giving up on it. Zero means forever")
+	flag.Float64Var(&flagIRCFloodRate, "irc_flood_rate", 1, "How many lines per second each IRC connection can send on average. Zero disables flood control")
+	flag.IntVar(&flagIRCFloodBurst, "irc_flood_burst", 5, "How many lines each IRC connection can send at once before irc_flood_rate kicks in")
+	flag.Float64Var(&flagIRCServerRate, "irc_server_flood_rate", 4, "How many lines per second all IRC connections to a server can send on average. Zero disables flood control")
+	flag.IntVar(&flagIRCServerBurst, "irc_server_flood_burst", 16, "How many lines all IRC connections to a server can send at once before irc_server_flood_rate kicks in")
+	flag.StringVar(&flagMetricsListen, "metrics_listen", "", "Address to serve metrics (eg. IRC send queue depths) on, at /debug/vars. If not given, metrics are not served")
+	flag.BoolVar(&flagIRCPlain, "irc_plain", false, "Send Telegram messages to IRC as plain text, without bold/italic/etc. formatting codes")
+	flag.BoolVar(&flagIRCMarkup, "irc_markup", false, "Render *bold*, _italic_, ~strikethrough~ and `code` typed by IRC users as formatting on Telegram")
+	flag.BoolVar(&flagIRCUpload, "irc_upload", false, "Upload images and videos linked on IRC to Telegram as native media, instead of sending the links as text")
+	flag.Int64Var(&flagIRCUploadMaxSize, "irc_upload_max_size", 20<<20, "Maximum size in bytes of media linked on IRC that is uploaded to Telegram. Larger media is sent as a link")
+	flag.StringVar(&flagTelegramAPIEndpoint, "telegram_api_endpoint", "", "URL of the Telegram Bot API server to use instead of https://api.telegram.org, eg. a self-hosted one")
+	flag.StringVar(&flagTelegramWebhookURL, "telegram_webhook_url", "", "Public URL on which Telegram should send updates to the bridge. If given, the bridge receives updates through a webhook instead of long polling")
+	flag.StringVar(&flagTelegramWebhookListen, "telegram_webhook_listen", ":8443", "Address to serve the webhook on")
+	flag.StringVar(&flagTelegramWebhookSecret, "telegram_webhook_secret", "", "Secret token Telegram must send with webhook updates. If not given, a random one is used")
+	flag.StringVar(&flagTelegramWebhookCert, "telegram_webhook_cert", "", "Path to PEM certificate to serve the webhook over HTTPS with. If not given, the webhook is served over HTTP, eg. behind a reverse proxy")
+	flag.StringVar(&flagTelegramWebhookKey, "telegram_webhook_key", "", "Path to PEM private key of telegram_webhook_cert")
+	flag.StringVar(&flagMediaListen, "media_listen", "", "Address to serve media posted on Telegram to IRC users on. If not given, media is linked through teleimg_root")
+	flag.StringVar(&flagMediaURL, "media_url", "", "Public URL under which media served on media_listen is reachable, eg. https://bridge.example.com/media/")
+	flag.StringVar(&flagMediaSecret, "media_secret", "", "Key to sign media URLs with, so that only media posted in bridged chats can be fetched. If not given, a random one is used, and media links stop working on restart")
+	flag.StringVar(&flagMediaCacheDir, "media_cache_dir", "", "Path to directory caching media served on media_listen. If not given, media is streamed from Telegram on every request")
+	flag.Int64Var(&flagMediaCacheSize, "media_cache_size", 1<<30, "Maximum total size in bytes of media_cache_dir. Zero means unlimited")
+	flag.DurationVar(&flagMediaCacheMaxAge, "media_cache_max_age", 7*24*time.Hour, "How long to keep media in media_cache_dir. Zero means forever")
+	flag.StringVar(&flagTelegramEdits, "telegram_edits", editsDiff, "How to relay Telegram message edits to IRC: 'diff' sends s/old/new/ corrections (or the full text if the change is too big), 'full' sends the full edited text, 'off' drops edits")
 	flag.Parse()
 
 	if flagTelegramToken == "" {
 		glog.Exitf("telegram_token must be set")
 	}
 
-	if flagIRCChannel == "" {
-		glog.Exitf("irc_channel must be set")
+	switch flagTelegramEdits {
+	case editsOff, editsDiff, editsFull:
+	default:
+		glog.Exitf("telegram_edits must be one of: %s, %s, %s", editsOff, editsDiff, editsFull)
 	}
-	if flagIRCLogin == "" {
-		flagIRCLogin = "lelegram"
+	if (flagTelegramWebhookCert == "") != (flagTelegramWebhookKey == "") {
+		glog.Exitf("telegram_webhook_cert and telegram_webhook_key must be given together")
 	}
-	glog.Infof("dabug: Backup login in IRC: %s", flagIRCLogin)
-	if flagNickSuffix == "" && flagNickPrefix == "" {
-		glog.Warning("No prefix nor suffix for nicks has been choosen. Default nick will have [t] suffix")
-		flagNickSuffix = "[t]"
+	if flagMediaListen != "" && flagMediaURL == "" {
+		glog.Exitf("media_url must be set with media_listen")
 	}
 
-	// Parse given group ID.
-	// If not set, start server in 'lame' mode, ie. one that will not actually
-	// perform any bridging, but will let you figure out the IDs of groups that
-	// this bot is part of.
-	var groupId int64
-	if flagTelegramChat == "" {
-		glog.Warningf("telegram_chat NOT GIVEN, STARTING IN LAME MODE")
-		glog.Warningf("Watch for logs to find out the ID of groups which this bot is part of. Then, restart the bot with telegram_chat set.")
+	var bridges []*bridgeConfig
+	if flagConfig != "" {
+		b, err := loadConfig(flagConfig)
+		if err != nil {
+			glog.Exitf("Could not load config: %v", err)
+		}
+		bridges = b
 	} else {
-		g, err := strconv.ParseInt(flagTelegramChat, 10, 64)
+		b, err := bridgeFromFlags()
 		if err != nil {
-			glog.Exitf("telegram_chat must be a number")
+			glog.Exitf("%v", err)
+		}
+		bridges = []*bridgeConfig{b}
+	}
+
+	var sasl *irc.SASLCredentials
+	if flagIRCSASLMechanism != "" {
+		sasl = &irc.SASLCredentials{
+			Mechanism: flagIRCSASLMechanism,
+			Login:     flagIRCSASLLogin,
+			Password:  flagIRCSASLPassword,
+		}
+		if err := sasl.Validate(); err != nil {
+			glog.Exitf("Invalid irc_sasl flags: %v", err)
+		}
+	}
+	var credentials irc.CredentialStore
+	if flagIRCSASLUsers != "" {
+		c, err := irc.LoadCredentialStore(flagIRCSASLUsers)
+		if err != nil {
+			glog.Exitf("Could not load irc_sasl_users: %v", err)
+		}
+		credentials = c
+	}
+	// EXTERNAL authenticates with the TLS client certificate, so without one
+	// it could only ever fail once connected.
+	if !flagIRCTLS || flagIRCTLSCert == "" {
+		if sasl != nil && sasl.External() {
+			glog.Exitf("irc_sasl_mechanism EXTERNAL needs irc_tls and irc_tls_cert")
+		}
+		for user, c := range credentials {
+			if c.External() {
+				glog.Exitf("irc_sasl_users: EXTERNAL for %q needs irc_tls and irc_tls_cert", user)
+			}
 		}
-		groupId = g
 	}
 
-	// https://tools.ietf.org/html/rfc2812#section-1.3 "Channel names are case insensitive"
-	mgr := irc.NewManager(flagIRCMaxConnections, flagIRCServer, strings.ToLower(flagIRCChannel), flagIRCLogin, flagNickPrefix, flagNickSuffix)
-	glog.V(4).Infof("telegram/debug4: Linking to group: %d", groupId)
-	s, err := newServer(groupId, mgr)
+	tel, err := newBotAPI(flagTelegramToken, flagTelegramAPIEndpoint)
 	if err != nil {
-		glog.Exitf("newServer(): %v", err)
+		glog.Exitf("when creating telegram bot: %v", err)
+	}
+	glog.Infof("Authorized with Telegram as %q", tel.Self.UserName)
+	t := newTelegram(tel)
+
+	// Stop cleanly (eg. deleting the Telegram webhook) when asked to.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sigs
+		glog.Infof("Got %v, stopping...", s)
+		cancel()
+	}()
+
+	if flagMetricsListen != "" {
+		go func() {
+			glog.Exitf("Serving metrics: %v", http.ListenAndServe(flagMetricsListen, nil))
+		}()
 	}
 
-	ctx := context.Background()
+	// Serve media to IRC users ourselves, if configured to.
+	var media *mediaProxy
+	if flagMediaListen != "" {
+		secret, err := mediaSecret()
+		if err != nil {
+			glog.Exitf("Could not generate media secret: %v", err)
+		}
+		media, err = newMediaProxy(tel, flagMediaURL, secret, flagMediaCacheDir, flagMediaCacheSize, flagMediaCacheMaxAge)
+		if err != nil {
+			glog.Exitf("Could not start media proxy: %v", err)
+		}
+		go func() {
+			glog.Exitf("Serving media: %v", media.serve(flagMediaListen))
+		}()
+	}
 
-	// Start IRC manager
-	go mgr.Run(ctx)
+	connLimit := irc.RateLimit{Rate: flagIRCFloodRate, Burst: flagIRCFloodBurst}
+	serverLimit := irc.RateLimit{Rate: flagIRCServerRate, Burst: flagIRCServerBurst}
+	// Managers connecting to the same IRC server share its flood control.
+	floods := make(map[string]*irc.ServerFlood)
 
-	// Start piping Telegram messages into telLog
-	go s.telegramLoop(ctx)
+	// Bridges on the same IRC network share a Manager, so that every
+	// Telegram user has a single IRC connection joining all their channels.
+	type network struct {
+		server, login, prefix, suffix string
+	}
+	mgrs := make(map[network]*irc.Manager)
+	for _, n := range networks(bridges) {
+		b := n[0]
+		glog.Infof("IRC network %s: backup login %s, nicks %s*%s", b.IRCServer, b.IRCLogin, b.NickPrefix, b.NickSuffix)
 
-	// Start piping IRC messages into ircLog
-	mgr.Subscribe(s.ircLog)
+		var tlsConfig *tls.Config
+		if flagIRCTLS {
+			c, err := ircTLSConfig(b.IRCServer)
+			if err != nil {
+				glog.Exitf("Could not configure IRC TLS: %v", err)
+			}
+			tlsConfig = c
+		}
+
+		channels := []string{}
+		for _, b := range n {
+			channels = append(channels, b.IRCChannel)
+		}
+		flood, ok := floods[b.IRCServer]
+		if !ok {
+			flood = irc.NewServerFlood(serverLimit)
+			floods[b.IRCServer] = flood
+		}
+		mgr := irc.NewManager(b.IRCMaxConnections, b.IRCServer, channels, b.IRCLogin, b.NickPrefix, b.NickSuffix,
+			tlsConfig, sasl, credentials, connLimit, flood)
+		mgrs[network{b.IRCServer, b.IRCLogin, b.NickPrefix, b.NickSuffix}] = mgr
+
+		// Start IRC manager
+		go mgr.Run(ctx)
+	}
+
+	// bridges running, waited for on shutdown
+	var wg sync.WaitGroup
+	for _, b := range bridges {
+		mgr := mgrs[network{b.IRCServer, b.IRCLogin, b.NickPrefix, b.NickSuffix}]
+		msgs, err := newMessageStore(b.MessageStore, flagMessageStoreSize)
+		if err != nil {
+			glog.Exitf("Could not open message store: %v", err)
+		}
+		toIRC, toTelegram, err := openSpools(b.SpoolDir)
+		if err != nil {
+			glog.Exitf("Could not open spools: %v", err)
+		}
 
-	// Start message processing bridge (connecting telLog and ircLog)
-	s.bridge(ctx)
+		glog.V(4).Infof("telegram/debug4: Linking to group: %d", b.TelegramChat)
+		s := newServer(b, tel, mgr, msgs, toIRC, toTelegram)
+		if media != nil {
+			s.media = media
+		}
+		t.bridges[b.TelegramChat] = s
+
+		// Start piping IRC messages into ircLog
+		mgr.Subscribe(b.IRCChannel, s.ircLog)
+
+		// Start message processing bridge (connecting telLog and ircLog)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.bridge(ctx)
+		}()
+	}
+
+	// Start piping Telegram messages into the bridges' telLogs
+	t.loop(ctx)
+
+	// Let the bridges spool what they hold (eg. a pending album) before
+	// closing their files.
+	cancel()
+	wg.Wait()
+	for _, s := range t.bridges {
+		s.close()
+	}
+}
+
+// ircTLSConfig builds a TLS configuration for IRC connections to a given
+// server from flags.
+func ircTLSConfig(server string) (*tls.Config, error) {
+	serverName := flagIRCTLSServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, fmt.Errorf("irc_server %q: %v", server, err)
+		}
+		serverName = host
+	}
+	c := &tls.Config{
+		ServerName: serverName,
+	}
+
+	if flagIRCTLSCA != "" {
+		pem, err := ioutil.ReadFile(flagIRCTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", flagIRCTLSCA)
+		}
+		c.RootCAs = pool
+	}
+
+	if flagIRCTLSCert != "" || flagIRCTLSKey != "" {
+		if flagIRCTLSCert == "" || flagIRCTLSKey == "" {
+			return nil, fmt.Errorf("irc_tls_cert and irc_tls_key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(flagIRCTLSCert, flagIRCTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
 }
 
 // bridge connects telLog with ircLog, exchanging messages both ways and
 // performing nick translation given an up-to-date nickmap.
 func (s *server) bridge(ctx context.Context) {
 	nickmap := make(map[string]string)
+	// presence changes on IRC waiting to be sent to Telegram, and a timer
+	// that fires when they should be sent
+	presence := []*irc.NotificationPresence{}
+	var presenceFlush <-chan time.Time
+	// items of an album from Telegram waiting to be sent to IRC as one
+	// message, and a timer that fires when no more items are expected
+	album := []*telegramPlain{}
+	var albumFlush <-chan time.Time
+
+	// Start delivering spooled messages.
+	go s.toIRC.run(ctx, s.deliverIRC)
+	go s.toTelegram.run(ctx, s.deliverTelegram)
+
 	for {
 		glog.V(32).Info("bridge/debug32: New element in queue")
 		select {
 		case <-ctx.Done():
+			// Spool a pending album, as Telegram will not send it again.
+			if len(album) > 0 {
+				s.relayAlbum(album, nickmap)
+			}
 			return
+		case <-presenceFlush:
+			// Send batched presence changes as one service line.
+			text := presenceSummary(presence)
+			presence = []*irc.NotificationPresence{}
+			presenceFlush = nil
+			glog.V(4).Infof("bridge/irc/debug4: presence: %s", text)
+			s.spoolTelegram("", &telegramOutbound{Plain: text})
+
+		case <-albumFlush:
+			s.relayAlbum(album, nickmap)
+			album = []*telegramPlain{}
+			albumFlush = nil
+
 		case m := <-s.telLog:
-			// Event from Telegram (message). Translate Telegram names into IRC names.
-			text := m.text
-			for t, i := range nickmap {
-				text = strings.ReplaceAll(text, "@"+t, i)
+			// Event from Telegram (message). Items of an album come as
+			// separate messages, right after each other: collect them, to
+			// send them to IRC as one.
+			if len(album) > 0 && (m.mediaGroup != album[0].mediaGroup || m.user != album[0].user) {
+				s.relayAlbum(album, nickmap)
+				album = []*telegramPlain{}
+				albumFlush = nil
 			}
-			glog.Infof("telegram/info/%s: %v", m.user, text)
-
-			// Attempt to route message to IRC twice.
-			// This blocks until success or failure, making sure the log stays
-			// totally ordered in the face of some of our IRC connections being
-			// dead/slow.
-			ctxT, cancel := context.WithTimeout(ctx, 31*time.Second)
-			err := s.mgr.SendMessage(ctxT, m.user, text)
-			if err != nil {
-				glog.Warningf("Attempting redelivery of %v after error: %v...", m, err)
-				err = s.mgr.SendMessage(ctx, m.user, text)
-				glog.Errorf("Redelivery of %v failed: %v...", m, err)
+			if m.mediaGroup != "" {
+				album = append(album, m)
+				albumFlush = time.After(albumDelay)
+				continue
 			}
-			cancel()
+			s.relayTelegram(m, nickmap)
 
 		case n := <-s.ircLog:
-			glog.V(4).Infof("bridge/irc/debug4: Get message from irc: %s", n.Message)
+			glog.V(4).Infof("bridge/irc/debug4: Get message from irc: %v", n.Message)
 			// Notification from IRC (message or new nickmap)
 			switch {
 			case n.Nickmap != nil:
@@ -178,30 +536,455 @@ func (s *server) bridge(ctx context.Context) {
 				}
 				glog.Infof("New nickmap: %v", nickmap)
 
+			case n.Presence != nil:
+				// Someone joined/left IRC. Batch these up, so that eg. a
+				// netsplit results in one message instead of hundreds.
+				if !flagIRCPresence {
+					continue
+				}
+				presence = append(presence, n.Presence)
+				if presenceFlush == nil {
+					presenceFlush = time.After(flagIRCPresenceDelay)
+				}
+
 			case n.Message != nil:
-				// New IRC message. Translate IRC names into Telegram names.
-				text := n.Message.Message
-				for t, i := range nickmap {
-					text = strings.ReplaceAll(text, i, "@"+t)
+				// New IRC message.
+				s.spoolTelegram(n.Message.Nick, s.outboundFromIRC(n.Message, nickmap))
+
+			case n.Notice != nil:
+				// New IRC notice, eg. from ChanServ.
+				s.spoolTelegram("", &telegramOutbound{
+					HTML:  fmt.Sprintf("<b>-%s-</b> %s", escapeHTML(n.Notice.Nick), htmlFromIRC(n.Notice.Message)),
+					Plain: fmt.Sprintf("-%s- %s", n.Notice.Nick, irc.StripFormatting(n.Notice.Message)),
+				})
+
+			case n.Topic != nil:
+				// IRC topic changed.
+				if flagIRCTopic {
+					s.spoolTelegram("", &telegramOutbound{
+						HTML:  fmt.Sprintf("<i>%s changed the topic to:</i> %s", escapeHTML(n.Topic.Nick), htmlFromIRC(n.Topic.Topic)),
+						Plain: fmt.Sprintf("%s changed the topic to: %s", n.Topic.Nick, irc.StripFormatting(n.Topic.Topic)),
+					})
 				}
-				// And send message to Telegram.
-				// Try to send Markdown message first
-				msg := tgbotapi.NewMessage(s.groupId, fmt.Sprintf("*<%s>* %s", n.Message.Nick, text))
-				msg.ParseMode = "Markdown"
-				glog.V(16).Infof("bridge/debug16: Sending message %s", msg.Text)
-				m, err := s.tel.Send(msg)
-				glog.V(8).Infof("bridge/debug8: Telegram send returns %d:%s", m.MessageID, m.Text)
-				if err != nil {
-					glog.Warningf("bridge: Cannot send message to telegram: %s", err)
-					// Try again as plaintext - cannot differ parsing problem from other now
-					msg = tgbotapi.NewMessage(s.groupId, fmt.Sprintf("<%s> %s", n.Message.Nick, text))
-					m, err = s.tel.Send(msg)
-					glog.V(8).Infof("bridge/debug8: Returned %d:%s", m.MessageID, m.Text)
+				if flagIRCTopicDesc {
+					_, err := s.tel.SetChatDescription(tgbotapi.SetChatDescriptionConfig{
+						ChatID:      s.groupId,
+						Description: truncateRunes(irc.StripFormatting(n.Topic.Topic), maxDescription),
+					})
 					if err != nil {
-						glog.Errorf("bridge: E: Cannot send message to telegram: %s", err)
+						glog.Errorf("bridge: E: Cannot set telegram group description: %s", err)
 					}
 				}
 			}
 		}
 	}
 }
+
+// close closes the spools and message store of a bridge that has stopped.
+func (s *server) close() {
+	for _, sp := range []*spool{s.toIRC, s.toTelegram} {
+		if err := sp.close(); err != nil {
+			glog.Errorf("Could not close spool %s: %v", sp.name, err)
+		}
+	}
+	if err := s.msgs.close(); err != nil {
+		glog.Errorf("Could not close message store: %v", err)
+	}
+}
+
+// relayTelegram spools a message from Telegram for delivery to IRC, and records
+// it in the message store.
+func (s *server) relayTelegram(m *telegramPlain, nickmap map[string]string) {
+	// Translate Telegram names into IRC names.
+	text := m.text
+	for t, i := range nickmap {
+		text = strings.ReplaceAll(text, "@"+t, i)
+	}
+	glog.Infof("telegram/info/%s: %v", m.user, text)
+
+	// Spool message for delivery to IRC.
+	// Messages of a user are delivered in order, but do not hold back those
+	// of other users.
+	err := s.toIRC.enqueue(m.user, &ircOutbound{
+		User:    m.user,
+		Text:    text,
+		ReplyTo: m.replyTo,
+		Action:  m.action,
+	})
+	if err != nil {
+		glog.Errorf("Could not spool %v: %v", m, err)
+	}
+	s.msgs.add(&messageEntry{
+		TelegramID:   m.messageID,
+		TelegramUser: m.user,
+		Text:         m.source,
+	})
+}
+
+// relayAlbum relays the items of an album from Telegram to IRC as one message,
+// recording each of them in the message store.
+func (s *server) relayAlbum(album []*telegramPlain, nickmap map[string]string) {
+	s.relayTelegram(mergeAlbum(album), nickmap)
+	for _, m := range album[1:] {
+		s.msgs.add(&messageEntry{
+			TelegramID:   m.messageID,
+			TelegramUser: m.user,
+			Text:         m.source,
+		})
+	}
+}
+
+// spoolTelegram spools a message for delivery to Telegram. Messages with the
+// same key (the IRC nick of their sender, or empty for service messages) are
+// delivered in order.
+func (s *server) spoolTelegram(key string, o *telegramOutbound) {
+	if err := s.toTelegram.enqueue(key, o); err != nil {
+		glog.Errorf("Could not spool %v: %v", o, err)
+	}
+}
+
+// maxDescription is the maximum length of a Telegram chat description.
+const maxDescription = 255
+
+// truncateRunes cuts text to at most n runes.
+func truncateRunes(text string, n int) string {
+	for i := range text {
+		if n == 0 {
+			return text[:i]
+		}
+		n--
+	}
+	return text
+}
+
+// ircSetupTimeout is how long an IRC connection can take to join a channel,
+// or to be found dead, before it is given up on.
+const ircSetupTimeout = 35 * time.Second
+
+// deliverIRC delivers a spooled message to IRC.
+func (s *server) deliverIRC(ctx context.Context, payload json.RawMessage, _ int) error {
+	o := &ircOutbound{}
+	if err := json.Unmarshal(payload, o); err != nil {
+		glog.Errorf("Dropping unparseable spooled message %s: %v", payload, err)
+		return nil
+	}
+	// Give the connection time to join the channel, or to be found dead and
+	// replaced once, and flood control time to send all lines of the message
+	// at the slower of the connection and server rates.
+	timeout := 2*ircSetupTimeout + time.Second
+	rate := flagIRCFloodRate
+	if flagIRCServerRate > 0 && (rate <= 0 || flagIRCServerRate < rate) {
+		rate = flagIRCServerRate
+	}
+	if rate > 0 {
+		// Long lines are split further by the IRC connection.
+		lines := strings.Count(o.Text, "\n") + 1 + len(o.Text)/400
+		timeout += time.Duration(float64(lines) / rate * float64(time.Second))
+	}
+	ctxT, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := s.mgr.SendReply(ctxT, s.channel, o.User, o.Text, o.ReplyTo, o.Action)
+	if errors.Is(err, irc.ErrPartial) {
+		// The rest of the message is still being sent.
+		glog.Warningf("Message from %s is taking long to send: %v", o.User, err)
+		return nil
+	}
+	if errors.Is(err, irc.ErrBanned) || errors.Is(err, irc.ErrNoNick) {
+		// Do not attempt to redeliver messages of users that can't get on
+		// the channel for a while.
+		glog.Warningf("Dropping message from %s: %v", o.User, err)
+		return nil
+	}
+	return err
+}
+
+// outboundFromIRC translates a message from IRC into a message to Telegram,
+// translating IRC names into Telegram names, and replying to the message it
+// refers to if possible.
+func (s *server) outboundFromIRC(m *irc.NotificationMessage, nickmap map[string]string) *telegramOutbound {
+	replyTo := s.replyTarget(m, nickmap)
+	html, plain := ircToTelegram(m.Nick, m.Message, m.Action, s.ircMarkup, nickmap)
+	o := &telegramOutbound{
+		HTML:    html,
+		Plain:   plain,
+		ReplyTo: replyTo,
+		Entry: &messageEntry{
+			Nick:   m.Nick,
+			IRCID:  m.ID,
+			Text:   m.Message,
+			Action: m.Action,
+		},
+	}
+	// IRC users correct themselves with s/old/new/. The correction is
+	// spooled after the message it corrects, so that it can be applied to
+	// it once delivered.
+	if !m.Action && parseCorrection(m.Message) != nil {
+		o.Correction = true
+		o.Nickmap = nickmap
+	}
+	// Links to images and videos are uploaded when the message is
+	// delivered, captioned with the rest of the message.
+	if link := uploadURL(m.Message); s.ircUpload && link != "" {
+		caption := uploadCaption(m.Message, link)
+		o.Upload = &telegramUpload{URL: link}
+		html, plain := ircToTelegram(m.Nick, caption, m.Action, s.ircMarkup, nickmap)
+		o.Upload.HTML, o.Upload.Plain = strings.TrimSpace(html), strings.TrimSpace(plain)
+	}
+	return o
+}
+
+// deliverTelegram delivers a spooled message to Telegram, and records it in
+// the message store.
+func (s *server) deliverTelegram(ctx context.Context, payload json.RawMessage, attempts int) error {
+	o := &telegramOutbound{}
+	if err := json.Unmarshal(payload, o); err != nil {
+		glog.Errorf("Dropping unparseable spooled message %s: %v", payload, err)
+		return nil
+	}
+	if o.Correction && o.Entry != nil && s.correctTelegram(o.Entry.Nick, o.Entry.Text, o.Nickmap) {
+		return nil
+	}
+	id := 0
+	// Media is only uploaded on the first attempt, so that a slow link
+	// doesn't hold up the messages after it again on every retry.
+	if o.Upload != nil && attempts == 0 {
+		var err error
+		id, err = s.uploadTelegram(ctx, o.Upload, o.ReplyTo)
+		if err != nil {
+			glog.Warningf("bridge: Cannot upload media to telegram, sending text: %v", err)
+		}
+		if id != 0 && o.Entry != nil {
+			o.Entry.Upload = o.Upload.URL
+		}
+	}
+	if id == 0 {
+		var err error
+		id, err = s.sendTelegram(o.HTML, o.Plain, o.ReplyTo)
+		if isPermanentError(err) {
+			// Retrying would only hold back the messages after it.
+			glog.Errorf("bridge: Dropping message to telegram: %s", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if o.Entry != nil {
+		o.Entry.TelegramID = id
+		s.msgs.add(o.Entry)
+	}
+	return nil
+}
+
+// sendTelegram sends a message to Telegram as HTML (if given) or plain text.
+// As the HTML is escaped, it is only resent as plain text if Telegram still
+// cannot parse it, and only sent without the reply if the replied-to message
+// is gone. It returns the ID of the sent message.
+func (s *server) sendTelegram(html, plain string, replyTo int) (int, error) {
+	msg := tgbotapi.NewMessage(s.groupId, plain)
+	if html != "" {
+		msg = tgbotapi.NewMessage(s.groupId, html)
+		msg.ParseMode = "HTML"
+	}
+	msg.ReplyToMessageID = replyTo
+	for {
+		glog.V(16).Infof("bridge/debug16: Sending message %s", msg.Text)
+		m, err := s.tel.Send(msg)
+		glog.V(8).Infof("bridge/debug8: Telegram send returns %d:%s", m.MessageID, m.Text)
+		switch {
+		case err == nil:
+			return m.MessageID, nil
+		case msg.ReplyToMessageID != 0 && isReplyError(err):
+			glog.Warningf("bridge: Replied-to message is gone, sending without reply: %s", err)
+			msg.ReplyToMessageID = 0
+		case msg.ParseMode != "" && isParseError(err):
+			glog.Warningf("bridge: Cannot send HTML message to telegram, sending plain text: %s", err)
+			msg.Text = plain
+			msg.ParseMode = ""
+		default:
+			glog.Errorf("bridge: E: Cannot send message to telegram: %s", err)
+			return 0, err
+		}
+	}
+}
+
+// isParseError returns whether Telegram rejected a message because of its
+// formatting.
+func isParseError(err error) bool {
+	return strings.Contains(err.Error(), "can't parse entities")
+}
+
+// isPermanentError returns whether Telegram rejected a request in a way that
+// retrying it won't help with, eg. because the request is invalid or the bot
+// was kicked from the chat. Flood control errors are not permanent.
+func isPermanentError(err error) bool {
+	var te tgbotapi.Error
+	if !errors.As(err, &te) || te.RetryAfter != 0 {
+		return false
+	}
+	return strings.HasPrefix(te.Message, "Bad Request") || strings.HasPrefix(te.Message, "Forbidden")
+}
+
+// isReplyError returns whether Telegram rejected a message because the
+// message it replies to is gone.
+func isReplyError(err error) bool {
+	e := err.Error()
+	return strings.Contains(e, "replied message not found") ||
+		strings.Contains(e, "reply message not found") ||
+		strings.Contains(e, "message to be replied not found")
+}
+
+// openSpools opens the spools of messages to IRC and Telegram kept in dir, or
+// in-memory spools if dir is empty.
+func openSpools(dir string) (toIRC, toTelegram *spool, err error) {
+	ircPath, telegramPath := "", ""
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, nil, err
+		}
+		ircPath = filepath.Join(dir, "irc.spool")
+		telegramPath = filepath.Join(dir, "telegram.spool")
+	}
+	toIRC, err = newSpool("irc", ircPath, flagSpoolMaxAge)
+	if err != nil {
+		return nil, nil, err
+	}
+	toTelegram, err = newSpool("telegram", telegramPath, flagSpoolMaxAge)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Messages of different users are sent to IRC through different
+	// connections, some of which might take long to come up. Messages to
+	// Telegram are sent one by one, to keep the conversation in order.
+	toIRC.concurrent = true
+	return toIRC, toTelegram, nil
+}
+
+// ircToTelegram renders a message from IRC into HTML and plain text Telegram
+// messages, translating IRC names into Telegram names. IRC formatting is kept
+// in HTML where Telegram has an equivalent, and stripped from plain text. If
+// markup is set, *bold*, _italic_, ~strikethrough~ and `code` typed by IRC
+// users are rendered too; otherwise they are sent literally.
+func ircToTelegram(nick, text string, action, markup bool, nickmap map[string]string) (html, plain string) {
+	for t, i := range nickmap {
+		text = strings.ReplaceAll(text, i, "@"+t)
+	}
+	body := text
+	if markup {
+		body = ircFromMarkup(text)
+	}
+	if action {
+		return fmt.Sprintf("<i>* %s %s</i>", escapeHTML(nick), htmlFromIRC(body)), fmt.Sprintf("* %s %s", nick, irc.StripFormatting(text))
+	}
+	return fmt.Sprintf("<b>&lt;%s&gt;</b> %s", escapeHTML(nick), htmlFromIRC(body)), fmt.Sprintf("<%s> %s", nick, irc.StripFormatting(text))
+}
+
+// editTelegram edits a message on Telegram as HTML, falling back to plain text
+// if Telegram cannot parse it.
+func (s *server) editTelegram(id int, html, plain string) error {
+	edit := tgbotapi.NewEditMessageText(s.groupId, id, html)
+	edit.ParseMode = "HTML"
+	_, err := s.tel.Send(edit)
+	if err != nil && isParseError(err) {
+		glog.Warningf("bridge: Cannot edit HTML message on telegram, editing plain text: %s", err)
+		_, err = s.tel.Send(tgbotapi.NewEditMessageText(s.groupId, id, plain))
+	}
+	return err
+}
+
+// editCaptionTelegram edits the caption of a photo or document on Telegram,
+// falling back to plain text like editTelegram.
+func (s *server) editCaptionTelegram(id int, html, plain string) error {
+	edit := tgbotapi.NewEditMessageCaption(s.groupId, id, html)
+	edit.ParseMode = "HTML"
+	_, err := s.tel.Send(edit)
+	if err != nil && isParseError(err) {
+		glog.Warningf("bridge: Cannot edit HTML caption on telegram, editing plain text: %s", err)
+		_, err = s.tel.Send(tgbotapi.NewEditMessageCaption(s.groupId, id, plain))
+	}
+	return err
+}
+
+// correctTelegram applies a s/old/new/ correction line sent on IRC by nick to
+// one of their last messages by editing it on Telegram. It returns whether the
+// correction was applied.
+func (s *server) correctTelegram(nick, line string, nickmap map[string]string) bool {
+	c := parseCorrection(line)
+	if c == nil {
+		return false
+	}
+	recent := s.msgs.lastN(func(e *messageEntry) bool {
+		return e.TelegramUser == "" && strings.EqualFold(e.Nick, nick)
+	}, correctionLookback)
+	for _, e := range recent {
+		text, ok := c.apply(e.Text)
+		if !ok {
+			continue
+		}
+		var err error
+		if e.Upload != "" {
+			// Uploaded media is captioned with the text without the link.
+			if !strings.Contains(text, e.Upload) {
+				continue
+			}
+			html, plain := ircToTelegram(e.Nick, uploadCaption(text, e.Upload), e.Action, s.ircMarkup, nickmap)
+			err = s.editCaptionTelegram(e.TelegramID, html, plain)
+		} else {
+			html, plain := ircToTelegram(e.Nick, text, e.Action, s.ircMarkup, nickmap)
+			err = s.editTelegram(e.TelegramID, html, plain)
+		}
+		if err != nil {
+			glog.Errorf("bridge: E: Cannot apply correction %q on telegram: %s", line, err)
+			return false
+		}
+		glog.Infof("bridge: Applied correction %q from %s to message %d", line, nick, e.TelegramID)
+		s.msgs.add(&messageEntry{
+			TelegramID: e.TelegramID,
+			Nick:       e.Nick,
+			IRCID:      e.IRCID,
+			Text:       text,
+			Action:     e.Action,
+			Upload:     e.Upload,
+		})
+		return true
+	}
+	return false
+}
+
+// highlightReplyWindow is how old a message can be to be considered the
+// target of a 'nick: ' highlight on IRC.
+const highlightReplyWindow = time.Hour
+
+var reHighlight = regexp.MustCompile(`^([^\s:,]+)[:,]\s`)
+
+// replyTarget returns the ID of the Telegram message that an IRC message
+// replies to, or zero. This is either the message referenced by an IRCv3 reply
+// tag, or the last recent message of the user highlighted with 'nick: '.
+func (s *server) replyTarget(m *irc.NotificationMessage, nickmap map[string]string) int {
+	if m.ReplyTo != "" {
+		if e := s.msgs.byIRCID(m.ReplyTo); e != nil {
+			return e.TelegramID
+		}
+	}
+
+	match := reHighlight.FindStringSubmatch(m.Message)
+	if match == nil {
+		return 0
+	}
+	nick := match[1]
+	since := time.Now().Add(-highlightReplyWindow).Unix()
+	e := s.msgs.last(func(e *messageEntry) bool {
+		if e.Time < since {
+			return false
+		}
+		if e.TelegramUser != "" {
+			// https://tools.ietf.org/html/rfc2812#section-2.2 nicks are case insensitive
+			return strings.EqualFold(nickmap[e.TelegramUser], nick)
+		}
+		return strings.EqualFold(e.Nick, nick)
+	})
+	if e == nil {
+		return 0
+	}
+	return e.TelegramID
+}
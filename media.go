@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/golang/glog"
+)
+
+// mediaLinker makes URLs under which IRC users can get media posted on
+// Telegram.
+type mediaLinker interface {
+	// link returns the URL of a Telegram file, to be served with a given
+	// file name.
+	link(fileID, name string) string
+}
+
+// teleimg links media to an external teleimg service at a given root URL.
+type teleimg string
+
+func (root teleimg) link(fileID, name string) string {
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	if ext == "" {
+		ext = "bin"
+	}
+	return string(root) + fileID + "." + ext
+}
+
+// mediaProxy serves Telegram files to IRC users, caching them on disk if
+// configured to. URLs are signed, so that only files posted in bridged chats
+// can be fetched through the proxy, and only under the name they were linked
+// with.
+type mediaProxy struct {
+	tel *tgbotapi.BotAPI
+	// root is the public URL of the proxy, ending with a slash
+	root   string
+	secret []byte
+	// dir caches files, unless empty. Files older than maxAge are dropped,
+	// and the least recently used files are dropped to fit in maxSize bytes.
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	// mu guards cache eviction
+	mu sync.Mutex
+}
+
+// mediaSecret returns the key that media URLs are signed with: either the one
+// given by flag, or a random one.
+func mediaSecret() ([]byte, error) {
+	if flagMediaSecret != "" {
+		return []byte(flagMediaSecret), nil
+	}
+	glog.Warningf("media_secret not given, media links will stop working on restart")
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// newMediaProxy returns a proxy serving Telegram files at a given public root
+// URL, caching up to maxSize bytes of files for up to maxAge in dir, unless dir
+// is empty.
+func newMediaProxy(tel *tgbotapi.BotAPI, root string, secret []byte, dir string, maxSize int64, maxAge time.Duration) (*mediaProxy, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("creating cache directory: %v", err)
+		}
+		// Remove files left half-fetched by a crash, as nothing else will.
+		stale, err := filepath.Glob(filepath.Join(dir, "fetch-*"))
+		if err != nil {
+			return nil, fmt.Errorf("listing cache directory: %v", err)
+		}
+		for _, f := range stale {
+			if err := os.Remove(f); err != nil {
+				return nil, fmt.Errorf("removing stale fetch: %v", err)
+			}
+		}
+	}
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	return &mediaProxy{
+		tel:     tel,
+		root:    root,
+		secret:  secret,
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}, nil
+}
+
+// sign returns the signature of a file ID and name.
+func (p *mediaProxy) sign(fileID, name string) string {
+	h := hmac.New(sha256.New, p.secret)
+	h.Write([]byte(fileID + "/" + name))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+func (p *mediaProxy) link(fileID, name string) string {
+	return p.root + p.sign(fileID, name) + "/" + url.PathEscape(fileID) + "/" + url.PathEscape(name)
+}
+
+// serve serves the proxy on a given address, under the path of its root URL.
+func (p *mediaProxy) serve(addr string) error {
+	u, err := url.Parse(p.root)
+	if err != nil {
+		return fmt.Errorf("parsing media_url: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(u.Path, http.StripPrefix(u.Path, p))
+	glog.Infof("Serving media on %s as %s", addr, p.root)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+		// Don't let slow or idle clients hold connections forever, while
+		// giving downloads of large files plenty of time.
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      10 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return srv.ListenAndServe()
+}
+
+// ServeHTTP serves a file given by a signed path: <signature>/<file ID>/<name>.
+func (p *mediaProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(r.URL.Path, "/", 3)
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	sig, fileID, name := parts[0], parts[1], parts[2]
+	if !hmac.Equal([]byte(sig), []byte(p.sign(fileID, name))) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if p.dir != "" {
+		p.serveCached(w, r, fileID, name)
+		return
+	}
+	body, size, err := p.fetch(fileID)
+	if err != nil {
+		glog.Errorf("media: fetching %s: %v", fileID, err)
+		http.Error(w, "could not fetch file from Telegram", http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+	br := bufio.NewReader(body)
+	headers(w, name)
+	if w.Header().Get("Content-Type") == "" {
+		head, _ := br.Peek(512)
+		w.Header().Set("Content-Type", http.DetectContentType(head))
+	}
+	if size > 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, br)
+}
+
+// serveCached serves a file from the cache, fetching it first if needed.
+func (p *mediaProxy) serveCached(w http.ResponseWriter, r *http.Request, fileID, name string) {
+	sum := sha256.Sum256([]byte(fileID))
+	cached := filepath.Join(p.dir, hex.EncodeToString(sum[:]))
+
+	fetched := false
+	fi, err := os.Stat(cached)
+	if err != nil || (p.maxAge > 0 && time.Since(fi.ModTime()) > p.maxAge) {
+		if err := p.store(fileID, cached); err != nil {
+			glog.Errorf("media: fetching %s: %v", fileID, err)
+			http.Error(w, "could not fetch file from Telegram", http.StatusBadGateway)
+			return
+		}
+		fetched = true
+	} else {
+		// Mark as recently used.
+		now := time.Now()
+		os.Chtimes(cached, now, now)
+	}
+
+	f, err := os.Open(cached)
+	if err != nil {
+		// Evicted in the meantime.
+		http.Error(w, "file not available, try again", http.StatusServiceUnavailable)
+		return
+	}
+	defer f.Close()
+	// Evict once the file is open, so that it can be served even if it does
+	// not fit in the cache.
+	if fetched {
+		p.evict()
+	}
+	fi, err = f.Stat()
+	if err != nil {
+		http.Error(w, "file not available, try again", http.StatusServiceUnavailable)
+		return
+	}
+	headers(w, name)
+	// ServeContent sniffs the Content-Type if it's not known from the name.
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// headers sets the headers of a file served with a given name. Files are
+// served as what they claim to be, but not as active content on our origin.
+func headers(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		w.Header().Set("Content-Type", t)
+	}
+}
+
+// store fetches a file from Telegram into the cache.
+func (p *mediaProxy) store(fileID, cached string) error {
+	body, _, err := p.fetch(fileID)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	tmp, err := ioutil.TempFile(p.dir, "fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cached)
+}
+
+// fetch resolves a file ID through getFile, and starts downloading the file.
+// It returns the file contents and size (if known).
+func (p *mediaProxy) fetch(fileID string) (io.ReadCloser, int64, error) {
+	f, err := p.tel.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, 0, fmt.Errorf("getFile: %v", err)
+	}
+	res, err := p.tel.Client.Get(f.Link(p.tel.Token))
+	if err != nil {
+		return nil, 0, fmt.Errorf("downloading: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("downloading: %s", res.Status)
+	}
+	return res.Body, res.ContentLength, nil
+}
+
+// evict removes files from the cache that are too old, or that don't fit in
+// its size, least recently used first.
+func (p *mediaProxy) evict() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	infos, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		glog.Errorf("media: listing cache: %v", err)
+		return
+	}
+	files := []os.FileInfo{}
+	total := int64(0)
+	for _, fi := range infos {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), "fetch-") {
+			continue
+		}
+		if p.maxAge > 0 && time.Since(fi.ModTime()) > p.maxAge {
+			os.Remove(filepath.Join(p.dir, fi.Name()))
+			continue
+		}
+		files = append(files, fi)
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		if p.maxSize <= 0 || total <= p.maxSize {
+			break
+		}
+		glog.V(4).Infof("media/debug4: evicting %s from cache", fi.Name())
+		os.Remove(filepath.Join(p.dir, fi.Name()))
+		total -= fi.Size()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// get requests a media URL from a proxy.
+func get(p *mediaProxy, link string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", link, nil)
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, "/media/")
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func TestMediaProxy(t *testing.T) {
+	fake, _, s := newTestBridge(t)
+	fake.AddFile(tgbotapi.File{FileID: "f1", FilePath: "documents/file_1.txt"}, []byte("hello"))
+	p, err := newMediaProxy(s.tel, "https://bridge.example.com/media", []byte("secret"), "", 0, 0)
+	if err != nil {
+		t.Fatalf("newMediaProxy: %v", err)
+	}
+
+	link := p.link("f1", "notes.txt")
+	if !strings.HasPrefix(link, "https://bridge.example.com/media/") || !strings.HasSuffix(link, "/f1/notes.txt") {
+		t.Fatalf("got link %q", link)
+	}
+	w := get(p, link)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("got %d %q, want 200 hello", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `inline; filename=notes.txt` {
+		t.Errorf("got Content-Disposition %q", got)
+	}
+
+	// Links can't be reused for other files or names.
+	for _, l := range []string{
+		strings.Replace(link, "/f1/", "/f2/", 1),
+		strings.Replace(link, "notes.txt", "notes.html", 1),
+	} {
+		if w := get(p, l); w.Code != http.StatusForbidden {
+			t.Errorf("%s: got %d, want %d", l, w.Code, http.StatusForbidden)
+		}
+	}
+	if got := len(fake.Calls("getFile")); got != 1 {
+		t.Errorf("got %d getFile calls, want 1", got)
+	}
+}
+
+func TestMediaProxyCache(t *testing.T) {
+	fake, _, s := newTestBridge(t)
+	fake.AddFile(tgbotapi.File{FileID: "a", FilePath: "photos/a.jpg"}, []byte("aaaaa"))
+	fake.AddFile(tgbotapi.File{FileID: "b", FilePath: "photos/b.jpg"}, []byte("bbbbb"))
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// A fetch left behind by a crash is removed on startup.
+	stale := filepath.Join(dir, "fetch-123")
+	if err := ioutil.WriteFile(stale, []byte("aa"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	p, err := newMediaProxy(s.tel, "https://bridge.example.com/media/", []byte("secret"), dir, 8, 0)
+	if err != nil {
+		t.Fatalf("newMediaProxy: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale fetch not removed: %v", err)
+	}
+
+	fetch := func(id, want string, downloads int) {
+		t.Helper()
+		w := get(p, p.link(id, "photo.jpg"))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%s: got %d %q, want 200 %q", id, w.Code, w.Body.String(), want)
+		}
+		if got := len(fake.Calls("download")); got != downloads {
+			t.Errorf("%s: got %d downloads, want %d", id, got, downloads)
+		}
+	}
+	fetch("a", "aaaaa", 1)
+	fetch("a", "aaaaa", 1)
+	// Only one file fits in the cache.
+	fetch("b", "bbbbb", 2)
+	fetch("b", "bbbbb", 2)
+	fetch("a", "aaaaa", 3)
+}
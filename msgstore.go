@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// messageEntry describes the origin of a message seen on Telegram, either
+// relayed by the bridge from IRC or sent natively by a Telegram user.
+type messageEntry struct {
+	// TelegramID is the ID of the message on Telegram.
+	TelegramID int `json:"telegram_id"`
+	// Nick is the IRC nick of the author, for messages relayed from IRC.
+	Nick string `json:"nick,omitempty"`
+	// TelegramUser is the Telegram name of the author, for messages sent
+	// from Telegram.
+	TelegramUser string `json:"telegram_user,omitempty"`
+	// IRCID is the IRCv3 message ID on IRC, if known.
+	IRCID string `json:"irc_id,omitempty"`
+	// Text is the text of the message.
+	Text string `json:"text"`
+	// Action is set for CTCP ACTIONs (/me) relayed from IRC.
+	Action bool `json:"action,omitempty"`
+	// Upload is the link to the media that a message from IRC was uploaded
+	// as, if it was sent as a photo or document captioned with the rest of
+	// the text.
+	Upload string `json:"upload,omitempty"`
+	// Time is the UNIX timestamp of when the message was recorded.
+	Time int64 `json:"time"`
+}
+
+// messageStore is a persistent mapping from Telegram message IDs to the IRC
+// origins of messages. It is backed by an append-only file of JSON entries
+// that is compacted to the newest max entries on load, and whenever it grows
+// to twice that.
+type messageStore struct {
+	mu sync.Mutex
+	// path of the backing file, or empty if the store is in-memory only
+	path string
+	f    *os.File
+	max  int
+
+	// entries, oldest first
+	entries    []*messageEntry
+	byTelegram map[int]*messageEntry
+	byIRC      map[string]*messageEntry
+}
+
+// newMessageStore opens (or creates) a messageStore at path. If path is empty,
+// the store is kept only in memory.
+func newMessageStore(path string, max int) (*messageStore, error) {
+	s := &messageStore{
+		path: path,
+		max:  max,
+	}
+	s.index(nil)
+	if path == "" {
+		return s, nil
+	}
+
+	entries := []*messageEntry{}
+	err := readJSONLines(path, "message store entry", func(line []byte) error {
+		e := &messageEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.index(entries)
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	glog.Infof("Loaded %d message store entries from %q", len(s.entries), path)
+	return s, nil
+}
+
+// index replaces the entries of the store, keeping the newest max.
+func (s *messageStore) index(entries []*messageEntry) {
+	if len(entries) > s.max {
+		entries = entries[len(entries)-s.max:]
+	}
+	s.entries = entries
+	s.byTelegram = make(map[int]*messageEntry)
+	s.byIRC = make(map[string]*messageEntry)
+	for _, e := range entries {
+		s.byTelegram[e.TelegramID] = e
+		if e.IRCID != "" {
+			s.byIRC[e.IRCID] = e
+		}
+	}
+}
+
+// compact rewrites the backing file with the current entries. It must be
+// called with mu held (or before the store is shared).
+func (s *messageStore) compact() error {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	s.index(s.entries)
+
+	f, err := rewriteJSONLines(s.path, len(s.entries), func(i int) interface{} { return s.entries[i] })
+	if err != nil {
+		return err
+	}
+	s.f = f
+	return nil
+}
+
+// add records a new entry in the store.
+func (s *messageStore) add(e *messageEntry) {
+	e.Time = time.Now().Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = append(s.entries, e)
+	s.byTelegram[e.TelegramID] = e
+	if e.IRCID != "" {
+		s.byIRC[e.IRCID] = e
+	}
+	if s.f == nil {
+		if len(s.entries) > 2*s.max {
+			s.index(s.entries)
+		}
+		return
+	}
+
+	if len(s.entries) > 2*s.max {
+		if err := s.compact(); err != nil {
+			glog.Errorf("Could not compact message store: %v", err)
+		}
+		return
+	}
+	if err := json.NewEncoder(s.f).Encode(e); err != nil {
+		glog.Errorf("Could not write to message store: %v", err)
+	}
+}
+
+// close closes the backing file. Entries added afterwards are only kept in
+// memory.
+func (s *messageStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// byTelegramID returns the entry for a given Telegram message ID, or nil.
+func (s *messageStore) byTelegramID(id int) *messageEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byTelegram[id]
+}
+
+// byIRCID returns the entry for a given IRCv3 message ID, or nil.
+func (s *messageStore) byIRCID(id string) *messageEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byIRC[id]
+}
+
+// last returns the newest entry for which match returns true, or nil.
+func (s *messageStore) last(match func(e *messageEntry) bool) *messageEntry {
+	res := s.lastN(match, 1)
+	if len(res) == 0 {
+		return nil
+	}
+	return res[0]
+}
+
+// lastN returns up to n newest distinct messages for which match returns
+// true, newest first. Only the newest entry of a Telegram message is
+// considered.
+func (s *messageStore) lastN(match func(e *messageEntry) bool, n int) []*messageEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []*messageEntry{}
+	for i := len(s.entries) - 1; i >= 0 && len(res) < n; i-- {
+		e := s.entries[i]
+		if s.byTelegram[e.TelegramID] != e {
+			// Superseded by a newer entry (eg. an edit).
+			continue
+		}
+		if match(e) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
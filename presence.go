@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hakierspejs/lelelegram/irc"
+)
+
+// presenceMaxNicks is the number of nicks listed per kind of presence change
+// in a summary before the rest is just counted.
+const presenceMaxNicks = 8
+
+// presenceSummary renders a batch of IRC presence changes into a single line,
+// eg. "alice, bob joined; carol quit (Ping timeout); dave is now dave_".
+// Changes of the same kind and reason are grouped together, so that netsplits
+// collapse into a single entry.
+func presenceSummary(ps []*irc.NotificationPresence) string {
+	type group struct {
+		kind   irc.PresenceKind
+		reason string
+		nicks  []string
+	}
+	groups := []*group{}
+	byKey := make(map[string]*group)
+
+	// nick changes and kicks, which are not grouped
+	singles := []string{}
+	for _, p := range ps {
+		switch p.Kind {
+		case irc.PresenceNick:
+			singles = append(singles, fmt.Sprintf("%s is now %s", p.Nick, p.Target))
+			continue
+		case irc.PresenceKick:
+			k := fmt.Sprintf("%s was kicked by %s", p.Target, p.Nick)
+			if p.Reason != "" {
+				k += fmt.Sprintf(" (%s)", p.Reason)
+			}
+			singles = append(singles, k)
+			continue
+		}
+
+		key := fmt.Sprintf("%d/%s", p.Kind, p.Reason)
+		g, ok := byKey[key]
+		if !ok {
+			g = &group{kind: p.Kind, reason: p.Reason}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		dup := false
+		for _, n := range g.nicks {
+			if n == p.Nick {
+				dup = true
+			}
+		}
+		if !dup {
+			g.nicks = append(g.nicks, p.Nick)
+		}
+	}
+
+	verbs := map[irc.PresenceKind]string{
+		irc.PresenceJoin: "joined",
+		irc.PresencePart: "left",
+		irc.PresenceQuit: "quit",
+	}
+	parts := []string{}
+	for _, g := range groups {
+		nicks := g.nicks
+		more := ""
+		if len(nicks) > presenceMaxNicks {
+			more = fmt.Sprintf(" and %d more", len(nicks)-presenceMaxNicks)
+			nicks = nicks[:presenceMaxNicks]
+		}
+		line := fmt.Sprintf("%s%s %s", strings.Join(nicks, ", "), more, verbs[g.kind])
+		if g.reason != "" {
+			line += fmt.Sprintf(" (%s)", g.reason)
+		}
+		parts = append(parts, line)
+	}
+	return strings.Join(append(parts, singles...), "; ")
+}
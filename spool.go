@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Delivery states of spooled messages.
+const (
+	// spoolPending messages are waiting to be delivered.
+	spoolPending = "pending"
+	// spoolSent messages have been delivered.
+	spoolSent = "sent"
+	// spoolFailed messages were given up on, after spool_max_age.
+	spoolFailed = "failed"
+)
+
+const (
+	// spoolBackoffMin and spoolBackoffMax bound the delay between delivery
+	// attempts of a message, which doubles after every failed attempt.
+	spoolBackoffMin = time.Second
+	spoolBackoffMax = 5 * time.Minute
+	// spoolCompactLines is how many lines the backing file of a spool can
+	// grow to before it is compacted to just the pending messages, whether
+	// or not any are still pending.
+	spoolCompactLines = 1000
+)
+
+// spoolEntry is a message in a spool, or (in the backing file) a change of
+// its state.
+type spoolEntry struct {
+	// ID orders messages in the spool.
+	ID int64 `json:"id"`
+	// State is one of spoolPending, spoolSent or spoolFailed.
+	State string `json:"state"`
+	// Attempts is the number of failed delivery attempts.
+	Attempts int `json:"attempts,omitempty"`
+	// Time is the UNIX timestamp of when the message was spooled.
+	Time int64 `json:"time,omitempty"`
+	// Key orders messages: messages with the same key are delivered in
+	// order, while others may overtake them while they're being retried.
+	Key string `json:"key,omitempty"`
+	// Payload is the message itself, as understood by the deliverer.
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// retry is when the next delivery attempt is due, and backoff the delay
+	// before the one after that.
+	retry   time.Time
+	backoff time.Duration
+}
+
+// spool is an ordered queue of outbound messages that are delivered in order,
+// retrying with backoff until delivery succeeds or the message becomes too
+// old. A message being retried only holds back later messages with the same
+// key, and so does one being delivered if the spool is concurrent. It is backed by an append-only file of entries and their state
+// changes, so that pending messages are replayed after a restart. Delivery is
+// at-least-once: a message that was delivered just before a crash will be
+// delivered again.
+type spool struct {
+	// name of the spool, for logs
+	name   string
+	maxAge time.Duration
+
+	mu sync.Mutex
+	// path of the backing file, or empty if the spool is in-memory only
+	path string
+	f    *os.File
+	// number of lines in the backing file
+	lines int
+	// ID of the next spooled message
+	next int64
+	// pending messages, oldest first
+	pending []*spoolEntry
+	// wake is signalled when a message is spooled
+	wake chan struct{}
+	// concurrent is set if messages with different keys are delivered at
+	// the same time, rather than one by one.
+	concurrent bool
+}
+
+// newSpool opens (or creates) a spool at path, replaying any messages that
+// are still pending. If path is empty, the spool is kept only in memory.
+// Messages older than maxAge are given up on, unless maxAge is zero.
+func newSpool(name, path string, maxAge time.Duration) (*spool, error) {
+	s := &spool{
+		name:   name,
+		maxAge: maxAge,
+		path:   path,
+		next:   1,
+		wake:   make(chan struct{}, 1),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	entries := make(map[int64]*spoolEntry)
+	err := readJSONLines(path, "spool entry", func(line []byte) error {
+		r := &spoolEntry{}
+		if err := json.Unmarshal(line, r); err != nil {
+			return err
+		}
+		if r.ID >= s.next {
+			s.next = r.ID + 1
+		}
+		e, ok := entries[r.ID]
+		if !ok {
+			entries[r.ID] = r
+			return nil
+		}
+		e.State = r.State
+		e.Attempts = r.Attempts
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		switch {
+		case e.Payload == nil:
+			glog.Warningf("Skipping spool entry %d without payload", e.ID)
+		case e.State == spoolPending:
+			s.pending = append(s.pending, e)
+		case e.State == spoolFailed:
+			glog.Warningf("Dropping failed spool entry %d: %s", e.ID, e.Payload)
+		}
+	}
+	sort.Slice(s.pending, func(i, j int) bool { return s.pending[i].ID < s.pending[j].ID })
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	glog.Infof("Loaded %d pending messages from spool %q", len(s.pending), path)
+	return s, nil
+}
+
+// compact rewrites the backing file with just the pending entries, dropping
+// the state changes of delivered ones. Callers hold mu, unless the spool is
+// still being opened.
+func (s *spool) compact() error {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+
+	f, err := rewriteJSONLines(s.path, len(s.pending), func(i int) interface{} { return s.pending[i] })
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.lines = len(s.pending)
+	return nil
+}
+
+// write appends an entry to the backing file. It must be called with mu held.
+func (s *spool) write(e *spoolEntry) {
+	if s.f == nil {
+		return
+	}
+	if err := json.NewEncoder(s.f).Encode(e); err != nil {
+		glog.Errorf("Could not write to spool %s: %v", s.name, err)
+		return
+	}
+	s.lines += 1
+	// Make sure spooled messages survive a crash of the machine.
+	if err := s.f.Sync(); err != nil {
+		glog.Errorf("Could not sync spool %s: %v", s.name, err)
+	}
+}
+
+// close closes the backing file. Messages spooled afterwards are only kept in
+// memory.
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// enqueue adds a message with a given key to the end of the spool.
+func (s *spool) enqueue(key string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	e := &spoolEntry{
+		ID:      s.next,
+		State:   spoolPending,
+		Time:    time.Now().Unix(),
+		Key:     key,
+		Payload: data,
+	}
+	s.next += 1
+	s.pending = append(s.pending, e)
+	s.write(e)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// update records a change of state of a pending message, removing it from the
+// spool if it's not pending anymore.
+func (s *spool) update(e *spoolEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.write(&spoolEntry{
+		ID:       e.ID,
+		State:    e.State,
+		Attempts: e.Attempts,
+	})
+	if e.State == spoolPending {
+		return
+	}
+	for j, p := range s.pending {
+		if p == e {
+			s.pending = append(s.pending[:j:j], s.pending[j+1:]...)
+			break
+		}
+	}
+	// Compacting leaves a line per pending message, so wait for the file to
+	// shrink by half at least.
+	if s.f != nil && s.lines >= spoolCompactLines && s.lines >= 2*len(s.pending) {
+		if err := s.compact(); err != nil {
+			glog.Errorf("Could not compact spool %s: %v", s.name, err)
+		}
+	}
+}
+
+// due returns the oldest pending message that is due for delivery, and isn't
+// held back by an older message with the same key or by a message with the
+// same key being delivered (busy). If there is none, it returns when the next
+// one will be due, or zero if none will be until more messages are spooled.
+func (s *spool) due(now time.Time, busy map[string]bool) (*spoolEntry, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := make(map[string]bool)
+	due := time.Time{}
+	for _, e := range s.pending {
+		if held[e.Key] || busy[e.Key] {
+			continue
+		}
+		held[e.Key] = true
+		if e.retry.After(now) {
+			if due.IsZero() || e.retry.Before(due) {
+				due = e.retry
+			}
+			continue
+		}
+		return e, time.Time{}
+	}
+	return nil, due
+}
+
+// run delivers spooled messages in order until ctx is done. A message is
+// retried (holding back the ones after it with the same key) until deliver
+// returns nil for it. deliver is also given the number of failed attempts to
+// deliver the message so far. If the spool is concurrent, messages with
+// different keys are delivered at the same time; otherwise one by one.
+func (s *spool) run(ctx context.Context, deliver func(ctx context.Context, payload json.RawMessage, attempts int) error) {
+	// keys of messages being delivered
+	busy := make(map[string]bool)
+	done := make(chan *spoolEntry)
+	for {
+		var e *spoolEntry
+		due := time.Time{}
+		if s.concurrent || len(busy) == 0 {
+			e, due = s.due(time.Now(), busy)
+		}
+		if e == nil {
+			var retry <-chan time.Time
+			if !due.IsZero() {
+				retry = time.After(time.Until(due))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			case <-retry:
+			case e := <-done:
+				delete(busy, e.Key)
+			}
+			continue
+		}
+
+		if s.maxAge != 0 && time.Since(time.Unix(e.Time, 0)) > s.maxAge {
+			glog.Errorf("spool/%s: giving up on message %d after %d attempts: %s", s.name, e.ID, e.Attempts, e.Payload)
+			e.State = spoolFailed
+			s.update(e)
+			continue
+		}
+
+		busy[e.Key] = true
+		go func(e *spoolEntry) {
+			err := deliver(ctx, e.Payload, e.Attempts)
+			// Messages that failed as the spool is stopping are left
+			// pending as they are, to be delivered after a restart.
+			if err == nil || ctx.Err() == nil {
+				s.delivered(e, err)
+			}
+			select {
+			case done <- e:
+			case <-ctx.Done():
+			}
+		}(e)
+	}
+}
+
+// delivered records the result of an attempt to deliver a message, scheduling
+// a retry with backoff if it failed.
+func (s *spool) delivered(e *spoolEntry, err error) {
+	if err == nil {
+		e.State = spoolSent
+		s.update(e)
+		return
+	}
+
+	if e.backoff == 0 {
+		e.backoff = spoolBackoffMin
+	}
+	e.Attempts += 1
+	e.retry = time.Now().Add(e.backoff)
+	s.update(e)
+	glog.Warningf("spool/%s: delivery of message %d failed (attempt %d), retrying in %v: %v", s.name, e.ID, e.Attempts, e.backoff, err)
+	e.backoff *= 2
+	if e.backoff > spoolBackoffMax {
+		e.backoff = spoolBackoffMax
+	}
+}
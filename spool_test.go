@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpoolKeys(t *testing.T) {
+	s, err := newSpool("test", "", 0)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+	for _, m := range []struct{ key, text string }{
+		{"alice", "a1"}, {"alice", "a2"}, {"bob", "b1"}, {"bob", "b2"},
+	} {
+		if err := s.enqueue(m.key, m.text); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	delivered := make(chan string)
+	go s.run(ctx, func(ctx context.Context, payload json.RawMessage, _ int) error {
+		var text string
+		json.Unmarshal(payload, &text)
+		if text == "a1" {
+			return errors.New("no")
+		}
+		select {
+		case delivered <- text:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+
+	// While alice's first message is retried, bob's are delivered in order,
+	// and alice's second is held back.
+	for _, want := range []string{"b1", "b2"} {
+		select {
+		case got := <-delivered:
+			if got != want {
+				t.Fatalf("delivered %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q not delivered", want)
+		}
+	}
+	select {
+	case got := <-delivered:
+		t.Fatalf("delivered %q while a1 is pending", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSpoolConcurrent(t *testing.T) {
+	s, err := newSpool("test", "", 0)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+	s.concurrent = true
+	for _, m := range []struct{ key, text string }{
+		{"alice", "a1"}, {"alice", "a2"}, {"bob", "b1"},
+	} {
+		if err := s.enqueue(m.key, m.text); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	delivered := make(chan string)
+	go s.run(ctx, func(ctx context.Context, payload json.RawMessage, _ int) error {
+		var text string
+		json.Unmarshal(payload, &text)
+		if text == "a1" {
+			<-release
+		}
+		select {
+		case delivered <- text:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+
+	// While alice's first message takes long to deliver, bob's is delivered,
+	// and alice's second waits for it.
+	want := func(texts ...string) {
+		t.Helper()
+		for _, want := range texts {
+			select {
+			case got := <-delivered:
+				if got != want {
+					t.Fatalf("delivered %q, want %q", got, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%q not delivered", want)
+			}
+		}
+	}
+	want("b1")
+	close(release)
+	want("a1", "a2")
+}
+
+func TestSpoolCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newSpool("test", filepath.Join(dir, "spool"), 0)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+	defer s.close()
+
+	// The file is compacted as traffic goes on, even while a message stays
+	// pending.
+	if err := s.enqueue("alice", "stuck"); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	for i := 0; i < 2*spoolCompactLines; i++ {
+		if err := s.enqueue("bob", i); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+		e := s.pending[len(s.pending)-1]
+		e.State = spoolSent
+		s.update(e)
+	}
+	if s.lines >= spoolCompactLines {
+		t.Errorf("got %d lines in spool, want it compacted", s.lines)
+	}
+	if len(s.pending) != 1 {
+		t.Errorf("got %d pending messages, want 1", len(s.pending))
+	}
+}
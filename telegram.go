@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -17,54 +19,122 @@ func mergeStringSplices(stringSplice1 []string, stringSplice2 []string) []string
 	return resultSplice
 }
 
-// telegramConnection runs a long-lived connection to the Telegram API to receive
-// updates and pipe resulting messages into telLog.
-func (s *server) telegramConnection(ctx context.Context) error {
-	u := tgbotapi.NewUpdate(0)
-	// TODO(q3k): figure out what the _fuck_ does this even mean
-	u.Timeout = 60
+// endpointTransport sends requests meant for the Telegram Bot API to another
+// endpoint, eg. a self-hosted Bot API server, or a fake one in tests.
+type endpointTransport struct {
+	endpoint *url.URL
+	rt       http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.endpoint.Scheme
+	r.URL.Host = t.endpoint.Host
+	r.URL.Path = strings.TrimSuffix(t.endpoint.Path, "/") + r.URL.Path
+	r.Host = t.endpoint.Host
+	return t.rt.RoundTrip(r)
+}
+
+// newBotAPI connects to the Telegram Bot API at a given endpoint, or at
+// api.telegram.org if endpoint is empty.
+func newBotAPI(token, endpoint string) (*tgbotapi.BotAPI, error) {
+	client := &http.Client{}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("parsing endpoint: %v", err)
+		}
+		client.Transport = &endpointTransport{u, http.DefaultTransport}
+	}
+	return tgbotapi.NewBotAPIWithClient(token, client)
+}
 
-	updates, err := s.tel.GetUpdatesChan(u)
-	if err != nil {
-		return fmt.Errorf("GetUpdatesChan(%+v): %v", u, err)
+// telegram is a connection to the Telegram API shared by all bridges. It
+// dispatches updates to bridges by chat ID.
+type telegram struct {
+	tel *tgbotapi.BotAPI
+	// bridges by Telegram chat ID
+	bridges map[int64]*server
+}
+
+func newTelegram(tel *tgbotapi.BotAPI) *telegram {
+	return &telegram{
+		tel:     tel,
+		bridges: make(map[int64]*server),
 	}
-	glog.V(8).Infof("telegram/debug8: New update")
+}
 
+// connection runs a long-lived connection to the Telegram API to receive
+// updates and pipe resulting messages into the bridges' telLogs.
+func (t *telegram) connection(ctx context.Context) error {
+	// Updates can't be polled while a webhook is set, eg. by a previous run
+	// in webhook mode.
+	if _, err := t.tel.MakeRequest("deleteWebhook", url.Values{}); err != nil {
+		return fmt.Errorf("deleteWebhook: %v", err)
+	}
+
+	offset := 0
 	for {
-		select {
-		case <-ctx.Done():
+		// Long poll for 60 seconds at a time.
+		updates, err := t.getUpdates(ctx, offset, 60)
+		if ctx.Err() != nil {
 			return ctx.Err()
-		case update, ok := <-updates:
-			if !ok {
-				return fmt.Errorf("Updates channel closed")
+		}
+		if err != nil {
+			return fmt.Errorf("getUpdates: %v", err)
+		}
+		glog.V(8).Infof("telegram/debug8: %d new updates", len(updates))
+		for _, u := range updates {
+			if u.UpdateID >= offset {
+				offset = u.UpdateID + 1
 			}
+			t.dispatch(u)
+		}
+	}
+}
 
-			// Dispatch update.
-			switch {
-			case update.Message != nil:
-				glog.V(4).Infof("telegram/debug4: New message: %d", update.Message.Chat.ID)
-				if update.Message.Chat.ID != s.groupId {
-					glog.Infof("[ignored group %d] <%s> %v", update.Message.Chat.ID, update.Message.From, update.Message.Text)
-					continue
-				}
-				date := time.Unix(int64(update.Message.Date), 0)
-				if time.Since(date) > 2*time.Minute {
-					glog.Infof("[old message] <%s> %v", update.Message.From, update.Message.Text)
-					continue
-				}
-				if msg := plainFromTelegram(s.tel.Self.ID, &update); msg != nil {
-					s.telLog <- msg
-				}
-			}
+// dispatch turns an update into a message on the telLog of the bridge of its
+// chat.
+func (t *telegram) dispatch(update *update) {
+	switch {
+	case update.Message != nil:
+		glog.V(4).Infof("telegram/debug4: New message: %d", update.Message.Chat.ID)
+		s, ok := t.bridges[update.Message.Chat.ID]
+		if !ok {
+			glog.Infof("[ignored group %d] <%s> %v", update.Message.Chat.ID, update.Message.From, update.Message.Text)
+			return
+		}
+		date := time.Unix(int64(update.Message.Date), 0)
+		if time.Since(date) > 2*time.Minute {
+			glog.Infof("[old message] <%s> %v", update.Message.From, update.Message.Text)
+			return
+		}
+		if msg := plainFromTelegram(t.tel.Self.ID, s.msgs, s.media, s.ircPlain, update); msg != nil {
+			s.telLog <- msg
+		}
+
+	case update.EditedMessage != nil:
+		glog.V(4).Infof("telegram/debug4: Edited message: %d", update.EditedMessage.Chat.ID)
+		s, ok := t.bridges[update.EditedMessage.Chat.ID]
+		if !ok || flagTelegramEdits == editsOff {
+			return
+		}
+		if msg := plainFromTelegramEdit(s.msgs, update.EditedMessage, flagTelegramEdits, s.ircPlain); msg != nil {
+			s.telLog <- msg
 		}
 	}
 }
 
-// telegramLoop maintains a telegramConnection.
-func (s *server) telegramLoop(ctx context.Context) {
+// loop maintains a connection.
+func (t *telegram) loop(ctx context.Context) {
 	for {
 		glog.V(4).Info("telegram/debug4: Starting telegram connection loop")
-		err := s.telegramConnection(ctx)
+		var err error
+		if flagTelegramWebhookURL != "" {
+			err = t.webhook(ctx)
+		} else {
+			err = t.connection(ctx)
+		}
 		if err == ctx.Err() {
 			glog.Infof("Telegram connection closing: %v", err)
 			return
@@ -95,23 +165,83 @@ func extractStickerToIRCText(m *tgbotapi.Message, parts []string) []string {
 	return parts
 }
 
-func extractMediaFromMessage(m *tgbotapi.Message) []string {
-	parts := []string{}
+// mediaExtensions are file extensions of media types that Telegram sends
+// without a file name.
+var mediaExtensions = map[string]string{
+	"audio/mpeg":      ".mp3",
+	"audio/ogg":       ".ogg",
+	"audio/mp4":       ".m4a",
+	"audio/x-m4a":     ".m4a",
+	"audio/flac":      ".flac",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/webm":      ".webm",
+}
+
+// mediaName returns a file name for media without one, made of base and an
+// extension matching mimeType, or the fallback extension.
+func mediaName(base, mimeType, fallback string) string {
+	if ext, ok := mediaExtensions[mimeType]; ok {
+		return base + ext
+	}
+	return base + fallback
+}
+
+// mediaMeta formats metadata of media, eg. " (1:05, 2.3 MB)". Unknown (zero)
+// durations and sizes are left out.
+func mediaMeta(duration, size int) string {
+	meta := []string{}
+	if duration > 0 {
+		d := time.Duration(duration) * time.Second
+		if d >= time.Hour {
+			meta = append(meta, fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60))
+		} else {
+			meta = append(meta, fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60))
+		}
+	}
+	if size > 0 {
+		switch {
+		case size >= 1000*1000:
+			meta = append(meta, fmt.Sprintf("%.1f MB", float64(size)/1000/1000))
+		case size >= 1000:
+			meta = append(meta, fmt.Sprintf("%.1f kB", float64(size)/1000))
+		default:
+			meta = append(meta, fmt.Sprintf("%d B", size))
+		}
+	}
+	if len(meta) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(meta, ", ") + ")"
+}
+
+// mapLink returns a link to a map of a location.
+func mapLink(l tgbotapi.Location) string {
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.5f&mlon=%.5f#map=17/%.5f/%.5f", l.Latitude, l.Longitude, l.Latitude, l.Longitude)
+}
+
+// ircFromMedia renders the media in a message (files, locations, polls, etc.)
+// for IRC, linking files through media. It returns an empty string if the
+// message has no media.
+func ircFromMedia(media mediaLinker, m *tgbotapi.Message, x *messageExtra) string {
 	switch {
 	case m.Animation != nil:
 		// This message contains an animation.
 		a := m.Animation
-		parts = append(parts, fmt.Sprintf("<uploaded animation: %s >\n", fileURL(a.FileID, "mp4")))
+		name := a.FileName
+		if name == "" {
+			name = "animation.mp4"
+		}
+		return fmt.Sprintf("<uploaded animation: %s >\n", media.link(a.FileID, name))
 
 	case m.Document != nil:
 		// This message contains a document.
 		d := m.Document
-		fnp := strings.Split(d.FileName, ".")
-		ext := "bin"
-		if len(fnp) > 1 {
-			ext = fnp[len(fnp)-1]
+		name := d.FileName
+		if name == "" {
+			name = "file.bin"
 		}
-		parts = append(parts, fmt.Sprintf("<uploaded file: %s >\n", fileURL(d.FileID, ext)))
+		return fmt.Sprintf("<uploaded file%s: %s >\n", mediaMeta(0, d.FileSize), media.link(d.FileID, name))
 
 	case m.Photo != nil:
 		// This message contains a photo.
@@ -122,7 +252,77 @@ func extractMediaFromMessage(m *tgbotapi.Message) []string {
 				hq = p
 			}
 		}
-		parts = append(parts, fmt.Sprintf("<uploaded photo: %s >\n", fileURL(hq.FileID, "jpg")))
+		return fmt.Sprintf("<uploaded photo: %s >\n", media.link(hq.FileID, "photo.jpg"))
+
+	case m.Video != nil:
+		v := m.Video
+		name := mediaName("video", v.MimeType, ".mp4")
+		return fmt.Sprintf("<uploaded video%s: %s >\n", mediaMeta(v.Duration, v.FileSize), media.link(v.FileID, name))
+
+	case m.VideoNote != nil:
+		// Round video message.
+		v := m.VideoNote
+		return fmt.Sprintf("<video message%s: %s >\n", mediaMeta(v.Duration, v.FileSize), media.link(v.FileID, "video.mp4"))
+
+	case m.Voice != nil:
+		v := m.Voice
+		name := mediaName("voice", v.MimeType, ".ogg")
+		return fmt.Sprintf("<voice message%s: %s >\n", mediaMeta(v.Duration, v.FileSize), media.link(v.FileID, name))
+
+	case m.Audio != nil:
+		a := m.Audio
+		title := a.Title
+		if a.Performer != "" && title != "" {
+			title = a.Performer + " - " + title
+		}
+		if title != "" {
+			title = " " + title
+		}
+		name := mediaName("audio", a.MimeType, ".mp3")
+		return fmt.Sprintf("<uploaded audio%s%s: %s >\n", title, mediaMeta(a.Duration, a.FileSize), media.link(a.FileID, name))
+
+	case m.Venue != nil:
+		// Venues come with their location, so they go first.
+		v := m.Venue
+		return fmt.Sprintf("<venue: %s, %s %s >\n", v.Title, v.Address, mapLink(v.Location))
+
+	case m.Location != nil:
+		l := m.Location
+		return fmt.Sprintf("<location: %.5f, %.5f %s >\n", l.Latitude, l.Longitude, mapLink(*l))
+
+	case m.Contact != nil:
+		c := m.Contact
+		name := strings.TrimSpace(c.FirstName + " " + c.LastName)
+		return fmt.Sprintf("<contact: %s, %s>\n", name, c.PhoneNumber)
+
+	case x.poll() != nil:
+		p := x.poll()
+		kind := "poll"
+		if p.Type == "quiz" {
+			kind = "quiz"
+		}
+		if p.AllowsMultipleAnswers {
+			kind += ", multiple answers"
+		}
+		lines := []string{fmt.Sprintf("<%s: %s>", kind, p.Question)}
+		for i, o := range p.Options {
+			lines = append(lines, fmt.Sprintf("%d. %s", i+1, o.Text))
+		}
+		return strings.Join(lines, "\n") + "\n"
+
+	case x.dice() != nil:
+		d := x.dice()
+		return fmt.Sprintf("<dice %s: %d>\n", d.Emoji, d.Value)
+	}
+	return ""
+}
+
+// extractMediaFromMessage renders the media in a message and its caption for
+// IRC.
+func extractMediaFromMessage(media mediaLinker, m *tgbotapi.Message, x *messageExtra) []string {
+	parts := []string{}
+	if r := ircFromMedia(media, m, x); r != "" {
+		parts = append(parts, r)
 	}
 	if len(m.Caption) > 0 {
 		parts = append(parts, fmt.Sprintf("<caption: %s>\n", m.Caption))
@@ -130,13 +330,20 @@ func extractMediaFromMessage(m *tgbotapi.Message) []string {
 	return parts
 }
 
-// plainFromTelegram turns a Telegram message into a plain text message.
-func plainFromTelegram(selfID int, u *tgbotapi.Update) *telegramPlain {
+// plainFromTelegram turns a Telegram message into a plain text message. The
+// message store is used to find out the IRC origin of quoted messages, and
+// media is linked by media. Formatting is rendered into mIRC
+// codes, unless plain is set.
+func plainFromTelegram(selfID int, msgs *messageStore, media mediaLinker, plain bool, u *update) *telegramPlain {
 	parts := []string{}
+	// IRCv3 message ID of the quoted message, if any.
+	replyTarget := ""
 
 	from := u.Message.From
 	replyto := u.Message.ReplyToMessage
 	text := u.Message.Text
+	// Messages starting with /me are sent to IRC as actions.
+	action := strings.HasPrefix(text, "/me ")
 
 	// This message is in reply to someone.
 	if replyto != nil && text != "" && replyto.From != nil {
@@ -148,10 +355,15 @@ func plainFromTelegram(selfID int, u *tgbotapi.Update) *telegramPlain {
 
 		// Check if the quoted message is from our bridge.
 		if replyto.From.ID == selfID {
-			// Someone replied to an IRC bridge message, extract nick and line from there
-			// eg: "<q3k> foo bar baz" -> ruid = q3k; quotedLine = foo bar baz
+			// Someone replied to an IRC bridge message. Find out the nick and
+			// line from the message store, or extract them from the message
+			// itself, eg: "<q3k> foo bar baz" -> ruid = q3k; quotedLine = foo bar baz
 			t := replyto.Text
-			if strings.HasPrefix(t, "<") {
+			if e := msgs.byTelegramID(replyto.MessageID); e != nil && e.Nick != "" {
+				ruid = e.Nick
+				quotedLine = strings.TrimSpace(strings.Split(e.Text, "\n")[0])
+				replyTarget = e.IRCID
+			} else if strings.HasPrefix(t, "<") {
 				p := strings.SplitN(t[1:], ">", 2)
 				nick := p[0]
 				quoted := strings.TrimSpace(p[1])
@@ -164,6 +376,7 @@ func plainFromTelegram(selfID int, u *tgbotapi.Update) *telegramPlain {
 			}
 		} else {
 			// Someone replied to a native telegram message.
+			quotedMedia := ircFromMedia(media, replyto, u.extra.reply())
 			switch {
 			case replyto.Text != "":
 				quoted := strings.TrimSpace(replyto.Text)
@@ -178,47 +391,202 @@ func plainFromTelegram(selfID int, u *tgbotapi.Update) *telegramPlain {
 				if quotedLine != "" {
 					quotedLine = quotedLine + "\n"
 				}
-			case replyto.Document != nil || replyto.Animation != nil || replyto.Photo != nil:
-				quotedLine = extractMediaFromMessage(replyto)[0]
+			case quotedMedia != "":
+				// First line of the media, eg. the question of a poll.
+				quotedLine = strings.SplitAfterN(quotedMedia, "\n", 2)[0]
 			case replyto.Sticker != nil:
 				quotedLine = extractStickerToIRCText(replyto, []string{})[0]
 			}
 		}
-		// If we have a line, quote it. Otherwise just refer to the nick without a quote.
-		if quotedLine != "" {
+		// If we have a line, quote it. Otherwise just refer to the nick without
+		// a quote, as for actions, which can't have a quote of their own.
+		if quotedLine != "" && !action {
 			// Truncate quoted message
 			if len(quotedLine) > 120 {
 				quotedLine = quotedLine[:115] + "... "
 			}
 			parts = append(parts, fmt.Sprintf("%s: >%s", ruid, quotedLine))
 		} else {
-			parts = append(parts, fmt.Sprintf("%s: ", ruid))
+			parts = append(parts, ruid+":")
 		}
 	}
 
-	parts = extractStickerToIRCText(u.Message, parts)
-	parts = mergeStringSplices(parts, extractMediaFromMessage(u.Message))
+	// This message was forwarded from someone else.
+	fwd := ""
+	if origin := forwardOrigin(u.Message, u.extra); origin != "" {
+		fwd = fmt.Sprintf("[fwd from %s]", origin)
+	}
+
+	body := extractStickerToIRCText(u.Message, []string{})
+	body = mergeStringSplices(body, extractMediaFromMessage(media, u.Message, u.extra))
 	// This message has some plain text.
 	if text != "" {
-		// Messages were truncated about length of 460. This length (412) is similar to what can be seen in irssi
-		for len(text) > 412 {
-			glog.V(16).Infof("telegram/debug16: Long message - %d", len(text))
-			separatorIndex := strings.LastIndex(text[:412], " ")
-			if separatorIndex == -1 {
-				separatorIndex = 410
-			}
-			parts = append(parts, text[:separatorIndex]+"\n")
-			text = text[separatorIndex+1:]
+		rendered := ircFromEntities(text, entities(u.Message), plain)
+		if action {
+			// Formatting of the message may start before /me.
+			rendered = strings.Replace(rendered, "/me ", "", 1)
 		}
-		parts = append(parts, text)
+		body = append(body, rendered)
 	}
 	// Was there anything that we extracted?
-	if len(parts) > 0 {
-		return &telegramPlain{from.String(), strings.Join(parts, " ")}
+	if len(body) == 0 {
+		return nil
+	}
+	source := text
+	if source == "" {
+		source = u.Message.Caption
+	}
+	joined := strings.Join(body, " ")
+	if fwd != "" {
+		// Mark every line as forwarded, as they are sent to IRC one by one.
+		joined = prefixLines(joined, fwd+" ")
+	}
+	m := &telegramPlain{
+		user:      from.String(),
+		text:      strings.Join(append(parts, joined), " "),
+		source:    source,
+		messageID: u.Message.MessageID,
+		replyTo:   replyTarget,
+		action:    action,
+	}
+	// Items of an album are merged into one line by the bridge, so keep
+	// their media on one line.
+	if g := u.extra.mediaGroup(); g != "" {
+		m.mediaGroup = g
+		m.body = strings.Join(strings.Fields(strings.Join(body, " ")), " ")
+		if fwd != "" {
+			parts = append(parts, fwd)
+		}
+		m.text = strings.Join(append(parts, m.body), " ")
 	}
-	return nil
+	return m
 }
 
-func fileURL(fid, ext string) string {
-	return flagTeleimgRoot + fid + "." + ext
+// prefixLines prefixes every non-empty line of text.
+func prefixLines(text, prefix string) string {
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			lines[i] = prefix + strings.TrimLeft(l, " ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// albumDelay is how long the bridge waits for more items of an album from
+// Telegram before sending it to IRC.
+const albumDelay = 2 * time.Second
+
+// mergeAlbum merges the messages of the items of an album into one message,
+// with the media of all items on one line.
+func mergeAlbum(album []*telegramPlain) *telegramPlain {
+	m := *album[0]
+	for _, a := range album[1:] {
+		m.text += " " + a.body
+	}
+	return &m
+}
+
+// forwardOrigin returns who originally sent a forwarded message, or "" if the
+// message is not a forward.
+func forwardOrigin(m *tgbotapi.Message, x *messageExtra) string {
+	name, signature := "", ""
+	if x != nil && x.ForwardOrigin != nil {
+		o := x.ForwardOrigin
+		switch {
+		case o.SenderUser != nil:
+			name = o.SenderUser.String()
+		case o.Chat != nil:
+			name = chatName(o.Chat)
+		case o.SenderChat != nil:
+			name = chatName(o.SenderChat)
+		default:
+			name = o.SenderUserName
+		}
+		signature = o.AuthorSignature
+	} else {
+		switch {
+		case m.ForwardFromChat != nil:
+			// Channel post, or anonymous admin of a group.
+			name = chatName(m.ForwardFromChat)
+		case m.ForwardFrom != nil:
+			name = m.ForwardFrom.String()
+		case x != nil:
+			// User hiding their account in forwards.
+			name = x.ForwardSenderName
+		}
+		if x != nil {
+			signature = x.ForwardSignature
+		}
+	}
+	if name != "" && signature != "" {
+		name += " (" + signature + ")"
+	}
+	return name
+}
+
+// chatName returns the name of a chat, eg. of a channel.
+func chatName(c *tgbotapi.Chat) string {
+	if c.Title != "" {
+		return c.Title
+	}
+	return c.UserName
+}
+
+// entities returns the formatting entities of the text of a message.
+func entities(m *tgbotapi.Message) []tgbotapi.MessageEntity {
+	if m.Entities == nil {
+		return nil
+	}
+	return *m.Entities
+}
+
+// plainFromTelegramEdit turns an edited Telegram message into a plain text
+// message announcing the edit on IRC, according to the given edit policy (one
+// of editsDiff or editsFull). The message store is used to find the previous
+// text of the message.
+func plainFromTelegramEdit(msgs *messageStore, m *tgbotapi.Message, policy string, plain bool) *telegramPlain {
+	if m.From == nil {
+		return nil
+	}
+	text := m.Text
+	if text == "" {
+		text = m.Caption
+	}
+	if text == "" {
+		return nil
+	}
+
+	correction := ""
+	if e := msgs.byTelegramID(m.MessageID); e != nil && e.TelegramUser != "" {
+		if e.Text == text {
+			// Nothing changed in the text, eg. only formatting was edited.
+			return nil
+		}
+		if policy == editsDiff {
+			correction = editCorrection(e.Text, text)
+		}
+	}
+	// Whole messages starting with /me are sent to IRC as actions, like
+	// in plainFromTelegram.
+	action := false
+	if correction == "" {
+		correction = text
+		if m.Text != "" {
+			action = strings.HasPrefix(text, "/me ")
+			correction = ircFromEntities(text, entities(m), plain)
+			if action {
+				correction = strings.Replace(correction, "/me ", "", 1)
+			}
+		}
+		correction += " (edited)"
+	}
+
+	return &telegramPlain{
+		user:      m.From.String(),
+		text:      correction,
+		source:    text,
+		messageID: m.MessageID,
+		action:    action,
+	}
 }
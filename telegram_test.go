@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+
+	"github.com/hakierspejs/lelelegram/irc"
+	"github.com/hakierspejs/lelelegram/irc/irctest"
+	"github.com/hakierspejs/lelelegram/telegramtest"
+)
+
+const (
+	testToken = "123:test"
+	testChat  = int64(-1001)
+)
+
+var testUser = &tgbotapi.User{ID: 2, FirstName: "Alice", UserName: "alice"}
+
+// newTestBridge starts a fake Telegram Bot API server, and returns it along
+// with a Telegram connection to it and a bridge of testChat (without IRC).
+func newTestBridge(t *testing.T) (*telegramtest.Server, *telegram, *server) {
+	t.Helper()
+	fake := telegramtest.NewServer(testToken)
+	t.Cleanup(fake.Close)
+
+	tel, err := newBotAPI(testToken, fake.URL)
+	if err != nil {
+		t.Fatalf("newBotAPI: %v", err)
+	}
+	msgs, err := newMessageStore("", 100)
+	if err != nil {
+		t.Fatalf("newMessageStore: %v", err)
+	}
+	toIRC, toTelegram, err := openSpools("")
+	if err != nil {
+		t.Fatalf("openSpools: %v", err)
+	}
+	c := &bridgeConfig{
+		TelegramChat: testChat,
+		IRCChannel:   "#test",
+		IRCPlain:     new(bool),
+		IRCMarkup:    new(bool),
+		IRCUpload:    new(bool),
+	}
+	s := newServer(c, tel, nil, msgs, toIRC, toTelegram)
+	tg := newTelegram(tel)
+	tg.bridges[testChat] = s
+	return fake, tg, s
+}
+
+// receive waits for a message to IRC on the telLog of a bridge.
+func receive(t *testing.T, s *server) *telegramPlain {
+	t.Helper()
+	select {
+	case m := <-s.telLog:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message received from Telegram")
+		return nil
+	}
+}
+
+func TestTelegramToIRC(t *testing.T) {
+	fake, tg, s := newTestBridge(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tg.connection(ctx)
+
+	fake.SendText(-42, testUser, "not bridged")
+	m := fake.SendText(testChat, testUser, "hello irc")
+	bold := &tgbotapi.Message{
+		From:     testUser,
+		Date:     int(time.Now().Unix()),
+		Chat:     &tgbotapi.Chat{ID: testChat},
+		Text:     "very bold",
+		Entities: &[]tgbotapi.MessageEntity{{Type: "bold", Offset: 5, Length: 4}},
+	}
+	fake.AddUpdate(tgbotapi.Update{Message: bold})
+
+	got := receive(t, s)
+	if got.user != "alice" || got.text != "hello irc" || got.messageID != m.MessageID {
+		t.Errorf("got %+v, want message %d from alice", got, m.MessageID)
+	}
+	got = receive(t, s)
+	if want := "very \x02bold\x0f"; got.text != want {
+		t.Errorf("got %q, want %q", got.text, want)
+	}
+	if len(fake.Calls("deleteWebhook")) != 1 {
+		t.Errorf("webhook not deleted before polling")
+	}
+}
+
+func TestIRCToTelegramEscapes(t *testing.T) {
+	fake, _, s := newTestBridge(t)
+
+	html, plain := ircToTelegram("a_b", "1 < 2 && *x* \x02y\x02", false, false, nil)
+	id, err := s.sendTelegram(html, plain, 0)
+	if err != nil {
+		t.Fatalf("sendTelegram: %v", err)
+	}
+	calls := fake.Calls("sendMessage")
+	if len(calls) != 1 {
+		t.Fatalf("got %d sendMessage calls, want 1", len(calls))
+	}
+	if got := calls[0].Params.Get("parse_mode"); got != "HTML" {
+		t.Errorf("got parse mode %q, want HTML", got)
+	}
+	if got, want := fake.Message(testChat, id).Text, "<a_b> 1 < 2 && *x* y"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIRCToTelegramMarkup(t *testing.T) {
+	for _, test := range []struct{ text, want string }{
+		{"*bold* _it_ ~gone~ snake_case_name", "<b>bold</b> <i>it</i> <s>gone</s> snake_case_name"},
+		// Code is left as it is.
+		{"`a *b* c` *d*", "<code>a *b* c</code> <b>d</b>"},
+		{"`a` `b`", "<code>a</code> <code>b</code>"},
+		// Including next to monospace typed as formatting codes, balanced or
+		// not.
+		{"\x11mono\x11 *b* `c`", "<code>mono</code> <b>b</b> <code>c</code>"},
+		{"a\x11b `c *d*` *e*", "a<code>b c *d*</code> <b>e</b>"},
+	} {
+		html, _ := ircToTelegram("bob", test.text, false, true, nil)
+		if want := "<b>&lt;bob&gt;</b> " + test.want; html != want {
+			t.Errorf("%q: got %q, want %q", test.text, html, want)
+		}
+	}
+}
+
+func TestIRCToTelegramReplyGone(t *testing.T) {
+	fake, _, s := newTestBridge(t)
+
+	id, err := s.sendTelegram("<b>hi</b>", "hi", 999)
+	if err != nil {
+		t.Fatalf("sendTelegram: %v", err)
+	}
+	calls := fake.Calls("sendMessage")
+	if len(calls) != 2 {
+		t.Fatalf("got %d sendMessage calls, want 2", len(calls))
+	}
+	if got := calls[1].Params.Get("reply_to_message_id"); got != "" && got != "0" {
+		t.Errorf("retry replies to %q, want no reply", got)
+	}
+	if got := fake.Message(testChat, id); got == nil || got.Text != "hi" {
+		t.Errorf("got message %+v, want hi", got)
+	}
+}
+
+func TestIRCToTelegramRejected(t *testing.T) {
+	fake, _, s := newTestBridge(t)
+
+	// Messages that Telegram rejects are dropped rather than retried.
+	s.spoolTelegram("bob", &telegramOutbound{Plain: ""})
+	s.spoolTelegram("bob", s.outboundFromIRC(&irc.NotificationMessage{Nick: "bob", Message: "hi"}, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.toTelegram.run(ctx, s.deliverTelegram)
+
+	calls, err := fake.WaitCalls("sendMessage", 2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got, want := calls[1].Params.Get("text"), "<b>&lt;bob&gt;</b> hi"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestIRCCorrection(t *testing.T) {
+	fake, _, s := newTestBridge(t)
+
+	// A correction spooled right after the message it corrects is applied
+	// once the message is delivered.
+	s.spoolTelegram("bob", s.outboundFromIRC(&irc.NotificationMessage{Nick: "bob", Message: "helo world"}, nil))
+	s.spoolTelegram("bob", s.outboundFromIRC(&irc.NotificationMessage{Nick: "bob", Message: "s/helo/hello/"}, nil))
+	// Others are sent as they are.
+	s.spoolTelegram("bob", s.outboundFromIRC(&irc.NotificationMessage{Nick: "bob", Message: "s/nope/yes/"}, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.toTelegram.run(ctx, s.deliverTelegram)
+
+	calls, err := fake.WaitCalls("sendMessage", 2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got := fake.Calls("editMessageText"); len(got) != 1 {
+		t.Fatalf("got %d editMessageText calls, want 1", len(got))
+	}
+	if got, want := calls[1].Params.Get("text"), "<b>&lt;bob&gt;</b> s/nope/yes/"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	e := s.msgs.last(func(e *messageEntry) bool { return e.Text == "hello world" })
+	if e == nil {
+		t.Fatalf("correction not recorded")
+	}
+	if got, want := fake.Message(testChat, e.TelegramID).Text, "<bob> hello world"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIRCCorrectionFromManager(t *testing.T) {
+	fake, _, s := newTestBridge(t)
+	is, err := irctest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(is.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.mgr = irc.NewManager(5, is.Addr, []string{s.channel}, "lelebot", "", "[t]", nil, nil, nil, irc.RateLimit{}, nil)
+	go s.mgr.Run(ctx)
+	s.mgr.Subscribe(s.channel, s.ircLog)
+	go s.bridge(ctx)
+	if err := is.WaitMember(s.channel, "lelebot[t]", true, 5*time.Second); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	// Corrections said right after the messages they correct on IRC become
+	// edits of them.
+	for i := 0; i < 10; i++ {
+		nick := fmt.Sprintf("bob%d", i)
+		is.Say(nick, s.channel, "helo world")
+		is.Say(nick, s.channel, "s/helo/hello/")
+	}
+	edits, err := fake.WaitCalls("editMessageText", 10, 5*time.Second)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	calls := fake.Calls("sendMessage")
+	if len(calls) != 10 {
+		t.Fatalf("got %d sendMessage calls, want 10", len(calls))
+	}
+	for i, c := range calls {
+		if got, want := c.Params.Get("text"), fmt.Sprintf("<b>&lt;bob%d&gt;</b> helo world", i); got != want {
+			t.Errorf("sent %q, want %q", got, want)
+		}
+	}
+	for i, c := range edits {
+		if got, want := c.Params.Get("text"), fmt.Sprintf("<b>&lt;bob%d&gt;</b> hello world", i); got != want {
+			t.Errorf("edited to %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	fake, tg, s := newTestBridge(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	defer func(url, listen, secret string) {
+		flagTelegramWebhookURL, flagTelegramWebhookListen, flagTelegramWebhookSecret = url, listen, secret
+	}(flagTelegramWebhookURL, flagTelegramWebhookListen, flagTelegramWebhookSecret)
+	flagTelegramWebhookURL = "https://bridge.example.com/telegram"
+	flagTelegramWebhookListen = addr
+	flagTelegramWebhookSecret = "s3cret"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- tg.webhook(ctx)
+	}()
+	if _, err := fake.WaitCalls("setWebhook", 1, 5*time.Second); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got := fake.Webhook().Get("secret_token"); got != "s3cret" {
+		t.Errorf("got secret token %q, want s3cret", got)
+	}
+
+	update, _ := json.Marshal(tgbotapi.Update{
+		UpdateID: 1,
+		Message: &tgbotapi.Message{
+			MessageID: 1,
+			From:      testUser,
+			Date:      int(time.Now().Unix()),
+			Chat:      &tgbotapi.Chat{ID: testChat},
+			Text:      "via webhook",
+		},
+	})
+	post := func(secret string) int {
+		req, _ := http.NewRequest("POST", "http://"+addr+"/telegram", bytes.NewReader(update))
+		req.Header.Set(webhookSecretHeader, secret)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("posting update: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if got := post("wrong"); got != http.StatusForbidden {
+		t.Errorf("update with wrong secret got status %d, want %d", got, http.StatusForbidden)
+	}
+	if got := post("s3cret"); got != http.StatusOK {
+		t.Errorf("update got status %d, want %d", got, http.StatusOK)
+	}
+	if got := receive(t, s); got.text != "via webhook" {
+		t.Errorf("got %q, want %q", got.text, "via webhook")
+	}
+
+	cancel()
+	<-done
+	if fake.Webhook() != nil {
+		t.Errorf("webhook not deleted on stop")
+	}
+}
+
+// parseTestUpdate parses an update with a message from alice in testChat,
+// given the JSON fields of the message other than its ID, sender, date and chat.
+func parseTestUpdate(t *testing.T, id int, fields string) *update {
+	t.Helper()
+	data := fmt.Sprintf(`{"update_id": %d, "message": {"message_id": %d, "from": {"id": 2, "username": "alice"}, "date": 0, "chat": {"id": -1001}, %s}}`, id, id, fields)
+	u, err := parseUpdate([]byte(data))
+	if err != nil {
+		t.Fatalf("parseUpdate(%s): %v", data, err)
+	}
+	return u
+}
+
+// plainToIRC renders a message given as by parseTestUpdate for IRC, with media
+// linked under https://img/.
+func plainToIRC(t *testing.T, id int, fields string) *telegramPlain {
+	t.Helper()
+	return plainFromTelegram(1, nil, teleimg("https://img/"), false, parseTestUpdate(t, id, fields))
+}
+
+func TestPlainToIRC(t *testing.T) {
+	for _, test := range []struct {
+		message string
+		want    string
+	}{
+		// Media.
+		{
+			`"voice": {"file_id": "v1", "duration": 7, "mime_type": "audio/ogg", "file_size": 12345}`,
+			"<voice message (0:07, 12.3 kB): https://img/v1.ogg >\n",
+		},
+		{
+			`"audio": {"file_id": "a1", "duration": 3725, "performer": "Band", "title": "Song", "mime_type": "audio/mpeg"}`,
+			"<uploaded audio Band - Song (1:02:05): https://img/a1.mp3 >\n",
+		},
+		{
+			`"video": {"file_id": "v2", "duration": 42, "mime_type": "video/quicktime", "file_size": 4100000}`,
+			"<uploaded video (0:42, 4.1 MB): https://img/v2.mov >\n",
+		},
+		{
+			`"video_note": {"file_id": "v3", "duration": 15, "length": 240}`,
+			"<video message (0:15): https://img/v3.mp4 >\n",
+		},
+		{
+			`"contact": {"phone_number": "+48123456789", "first_name": "Bob", "last_name": "Smith"}`,
+			"<contact: Bob Smith, +48123456789>\n",
+		},
+		{
+			`"location": {"latitude": 52.2297, "longitude": 21.0122}`,
+			"<location: 52.22970, 21.01220 https://www.openstreetmap.org/?mlat=52.22970&mlon=21.01220#map=17/52.22970/21.01220 >\n",
+		},
+		{
+			`"location": {"latitude": 1, "longitude": 2}, "venue": {"location": {"latitude": 1, "longitude": 2}, "title": "Hackerspace", "address": "Main St 1"}`,
+			"<venue: Hackerspace, Main St 1 https://www.openstreetmap.org/?mlat=1.00000&mlon=2.00000#map=17/1.00000/2.00000 >\n",
+		},
+		{
+			`"poll": {"question": "Pizza?", "options": [{"text": "yes"}, {"text": "no"}], "type": "regular"}`,
+			"<poll: Pizza?>\n1. yes\n2. no\n",
+		},
+		{
+			`"dice": {"emoji": "🎲", "value": 4}`,
+			"<dice 🎲: 4>\n",
+		},
+		// Forwards.
+		{
+			`"text": "hi", "forward_from": {"id": 3, "first_name": "Bob", "username": "bob"}, "forward_date": 1`,
+			"[fwd from bob] hi",
+		},
+		{
+			`"text": "news", "forward_from_chat": {"id": -100, "type": "channel", "title": "Announcements"}, "forward_signature": "Carol", "forward_date": 1`,
+			"[fwd from Announcements (Carol)] news",
+		},
+		{
+			`"text": "secret", "forward_sender_name": "Dave Hidden", "forward_date": 1`,
+			"[fwd from Dave Hidden] secret",
+		},
+		{
+			`"text": "new api", "forward_origin": {"type": "channel", "chat": {"id": -100, "type": "channel", "username": "chan"}, "author_signature": "Eve"}`,
+			"[fwd from chan (Eve)] new api",
+		},
+		{
+			`"text": "one\ntwo\n\nthree", "forward_from": {"id": 3, "first_name": "Bob", "username": "bob"}, "forward_date": 1`,
+			"[fwd from bob] one\n[fwd from bob] two\n\n[fwd from bob] three",
+		},
+		{
+			`"photo": [{"file_id": "p1", "width": 1, "height": 1}], "forward_origin": {"type": "hidden_user", "sender_user_name": "Frank"}`,
+			"[fwd from Frank] <uploaded photo: https://img/p1.jpg >\n",
+		},
+		// Actions.
+		{`"text": "/me waves"`, "waves"},
+		{`"text": "/me waves", "entities": [{"type": "bold", "offset": 0, "length": 9}]`, "\x02waves\x0f"},
+		// Replies refer to the quoted user, but don't quote them.
+		{
+			`"text": "/me waves back", "reply_to_message": {"message_id": 5, "from": {"id": 3, "username": "bob"}, "date": 0, "chat": {"id": -1001}, "text": "hi all"}`,
+			"@bob: waves back",
+		},
+	} {
+		m := plainToIRC(t, 1, test.message)
+		if m == nil {
+			t.Errorf("%s: message dropped", test.message)
+			continue
+		}
+		// Only messages starting with /me are actions.
+		action := strings.HasPrefix(test.message, `"text": "/me `)
+		if m.text != test.want || m.action != action {
+			t.Errorf("%s: got %q (action %v), want %q (action %v)", test.message, m.text, m.action, test.want, action)
+		}
+	}
+}
+
+func TestEditedActionToIRC(t *testing.T) {
+	msgs, err := newMessageStore("", 100)
+	if err != nil {
+		t.Fatalf("newMessageStore: %v", err)
+	}
+	msgs.add(&messageEntry{TelegramID: 1, TelegramUser: "alice", Text: "/me waves"})
+	m := parseTestUpdate(t, 1, `"text": "/me waves back"`).Message
+
+	// Edits announced in full are actions, like the messages they edit.
+	got := plainFromTelegramEdit(msgs, m, editsFull, false)
+	if got == nil || !got.action || got.text != "waves back (edited)" {
+		t.Errorf("got %+v, want action %q", got, "waves back (edited)")
+	}
+	// Corrections are not.
+	got = plainFromTelegramEdit(msgs, m, editsDiff, false)
+	if got == nil || got.action {
+		t.Errorf("got %+v, want correction", got)
+	}
+}
+
+func TestAlbumSpooledOnShutdown(t *testing.T) {
+	_, _, s := newTestBridge(t)
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s.toIRC, s.toTelegram, err = openSpools(dir)
+	if err != nil {
+		t.Fatalf("openSpools: %v", err)
+	}
+	// Not running, so nothing is delivered.
+	s.mgr = irc.NewManager(1, "", []string{s.channel}, "lelebot", "", "", nil, nil, nil, irc.RateLimit{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.bridge(ctx)
+		close(done)
+	}()
+	for i, photo := range []string{"p1", "p2"} {
+		s.telLog <- &telegramPlain{user: "alice", text: photo, body: photo, messageID: i + 1, mediaGroup: "g1"}
+	}
+	// Wait for the bridge to collect the album, then stop it before the
+	// album is complete.
+	for len(s.telLog) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("bridge did not stop")
+	}
+	s.close()
+
+	toIRC, err := newSpool("irc", filepath.Join(dir, "irc.spool"), 0)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+	if len(toIRC.pending) != 1 {
+		t.Fatalf("got %d spooled messages, want 1", len(toIRC.pending))
+	}
+	o := &ircOutbound{}
+	if err := json.Unmarshal(toIRC.pending[0].Payload, o); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if o.User != "alice" || o.Text != "p1 p2" {
+		t.Errorf("got %+v, want album from alice", o)
+	}
+}
+
+func TestAlbumToIRC(t *testing.T) {
+	album := []*telegramPlain{}
+	for i, item := range []string{
+		`"photo": [{"file_id": "p1", "width": 1, "height": 1}], "caption": "our\ntrip"`,
+		`"photo": [{"file_id": "p2", "width": 1, "height": 1}]`,
+		`"video": {"file_id": "v1", "duration": 5, "mime_type": "video/mp4"}`,
+	} {
+		m := plainToIRC(t, i+1, `"media_group_id": "g1", "forward_from": {"id": 3, "username": "bob"}, `+item)
+		if m == nil || m.mediaGroup != "g1" {
+			t.Fatalf("got %+v, want album item", m)
+		}
+		album = append(album, m)
+	}
+
+	m := mergeAlbum(album)
+	want := "[fwd from bob] <uploaded photo: https://img/p1.jpg > <caption: our trip> <uploaded photo: https://img/p2.jpg > <uploaded video (0:05): https://img/v1.mp4 >"
+	if m.text != want {
+		t.Errorf("got %q, want %q", m.text, want)
+	}
+	if m.messageID != 1 || m.source != "our\ntrip" {
+		t.Errorf("got message %d with source %q, want 1 with the caption", m.messageID, m.source)
+	}
+}
@@ -0,0 +1,571 @@
+// Package telegramtest provides an in-process fake of the Telegram Bot API,
+// for tests of code talking to Telegram through tgbotapi.
+package telegramtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Bot is the user of the fake bot, as returned by getMe.
+var Bot = tgbotapi.User{
+	ID:        1,
+	FirstName: "Test",
+	UserName:  "testbot",
+}
+
+// Call is a Bot API method called on the fake server.
+type Call struct {
+	Method string
+	Params url.Values
+	// Files are the contents of uploaded files by field name.
+	Files map[string][]byte
+}
+
+// Server is a fake Telegram Bot API server. It implements getMe, getUpdates,
+// sendMessage, sendPhoto, sendDocument, editMessageText, editMessageCaption,
+// getFile, setWebhook, deleteWebhook and setChatDescription, serves file
+// downloads, and records all calls (downloads as "download" calls). Point a
+// tgbotapi.BotAPI at it by sending requests to api.telegram.org to URL
+// instead.
+type Server struct {
+	*httptest.Server
+	// Token that the bot must use.
+	Token string
+
+	mu sync.Mutex
+	// updates, and the ID of the next one
+	updates    []tgbotapi.Update
+	nextUpdate int
+	// ID of the next message in any chat
+	nextMessage int
+	// messages by chat and message ID
+	messages map[int64]map[int]*tgbotapi.Message
+	// files by file ID, and their contents by file path
+	files    map[string]*tgbotapi.File
+	contents map[string][]byte
+	webhook  url.Values
+	calls    []*Call
+	// changed is closed and replaced whenever there are new updates or calls
+	changed chan struct{}
+	closed  chan struct{}
+}
+
+// NewServer starts a fake Bot API server for a bot with a given token.
+func NewServer(token string) *Server {
+	s := &Server{
+		Token:       token,
+		nextUpdate:  1,
+		nextMessage: 1,
+		messages:    make(map[int64]map[int]*tgbotapi.Message),
+		files:       make(map[string]*tgbotapi.File),
+		contents:    make(map[string][]byte),
+		changed:     make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Close stops the server, aborting pending getUpdates calls.
+func (s *Server) Close() {
+	close(s.closed)
+	s.Server.Close()
+}
+
+// notify wakes up everyone waiting for changes. It must be called with mu
+// held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// store records a message in a chat, assigning it an ID if it has none. It
+// must be called with mu held.
+func (s *Server) store(m *tgbotapi.Message) {
+	if m.MessageID == 0 {
+		m.MessageID = s.nextMessage
+		s.nextMessage += 1
+	} else if m.MessageID >= s.nextMessage {
+		s.nextMessage = m.MessageID + 1
+	}
+	chat, ok := s.messages[m.Chat.ID]
+	if !ok {
+		chat = make(map[int]*tgbotapi.Message)
+		s.messages[m.Chat.ID] = chat
+	}
+	chat[m.MessageID] = m
+}
+
+// AddUpdate queues an update to be received by the bot. Messages in it are
+// stored, so that the bot can reply to them.
+func (s *Server) AddUpdate(u tgbotapi.Update) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u.Message != nil {
+		s.store(u.Message)
+	}
+	u.UpdateID = s.nextUpdate
+	s.nextUpdate += 1
+	s.updates = append(s.updates, u)
+	s.notify()
+}
+
+// SendText queues an update with a new text message from a user to a chat,
+// and returns it.
+func (s *Server) SendText(chatID int64, from *tgbotapi.User, text string) *tgbotapi.Message {
+	m := &tgbotapi.Message{
+		From: from,
+		Date: int(time.Now().Unix()),
+		Chat: &tgbotapi.Chat{ID: chatID, Type: "supergroup"},
+		Text: text,
+	}
+	s.AddUpdate(tgbotapi.Update{Message: m})
+	return m
+}
+
+// AddFile makes a file available through getFile, and its content available
+// for download at its file path.
+func (s *Server) AddFile(f tgbotapi.File, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[f.FileID] = &f
+	s.contents[f.FilePath] = content
+}
+
+// Calls returns the calls of a given method so far, or of all methods if
+// method is empty.
+func (s *Server) Calls(method string) []*Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []*Call{}
+	for _, c := range s.calls {
+		if method == "" || c.Method == method {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// WaitCalls waits until there were at least n calls of a given method, and
+// returns them. An error is returned if that does not happen within timeout.
+func (s *Server) WaitCalls(method string, n int, timeout time.Duration) ([]*Call, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+		if calls := s.Calls(method); len(calls) >= n {
+			return calls, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, fmt.Errorf("got %d %s calls, wanted %d", len(s.Calls(method)), method, n)
+		}
+	}
+}
+
+// Message returns a message in a chat, as sent or edited by the bot, or nil.
+func (s *Server) Message(chatID int64, id int) *tgbotapi.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.messages[chatID][id]
+}
+
+// Webhook returns the parameters of the current webhook, or nil if none is
+// set.
+func (s *Server) Webhook() url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.webhook
+}
+
+// reMethod matches the path of Bot API methods, and reFile the path of file
+// downloads.
+var (
+	reMethod = regexp.MustCompile(`^/bot([^/]+)/([A-Za-z]+)$`)
+	reFile   = regexp.MustCompile(`^/file/bot([^/]+)/(.+)$`)
+)
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if f := reFile.FindStringSubmatch(r.URL.Path); f != nil && f[1] == s.Token {
+		s.mu.Lock()
+		s.calls = append(s.calls, &Call{Method: "download", Params: url.Values{"file_path": {f[2]}}})
+		s.notify()
+		content, ok := s.contents[f[2]]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+		return
+	}
+	m := reMethod.FindStringSubmatch(r.URL.Path)
+	if m == nil || m[1] != s.Token {
+		reply(w, http.StatusNotFound, nil, "Not Found")
+		return
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		reply(w, http.StatusBadRequest, nil, "Bad Request: "+err.Error())
+		return
+	}
+	method, params := m[2], r.Form
+	files, err := readFiles(r)
+	if err != nil {
+		reply(w, http.StatusBadRequest, nil, "Bad Request: "+err.Error())
+		return
+	}
+
+	if method == "getUpdates" {
+		s.getUpdates(w, params)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, &Call{Method: method, Params: params, Files: files})
+	s.notify()
+
+	switch method {
+	case "getMe":
+		reply(w, http.StatusOK, Bot, "")
+
+	case "sendMessage":
+		chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+		msg := &tgbotapi.Message{
+			From: &Bot,
+			Date: int(time.Now().Unix()),
+			Chat: &tgbotapi.Chat{ID: chatID, Type: "supergroup"},
+		}
+		if err := s.format(msg, params); err != "" {
+			reply(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if err := s.replyTo(msg, params); err != "" {
+			reply(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		s.store(msg)
+		reply(w, http.StatusOK, msg, "")
+
+	case "sendPhoto", "sendDocument":
+		chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+		msg := &tgbotapi.Message{
+			From: &Bot,
+			Date: int(time.Now().Unix()),
+			Chat: &tgbotapi.Chat{ID: chatID, Type: "supergroup"},
+		}
+		field := "photo"
+		if method == "sendDocument" {
+			field = "document"
+		}
+		content, ok := files[field]
+		if !ok {
+			reply(w, http.StatusBadRequest, nil, "Bad Request: there is no "+field+" in the request")
+			return
+		}
+		caption, err := s.caption(params)
+		if err != "" {
+			reply(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		msg.Caption = caption
+		if err := s.replyTo(msg, params); err != "" {
+			reply(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		s.store(msg)
+		// Uploaded files can be downloaded back.
+		f := &tgbotapi.File{
+			FileID:   fmt.Sprintf("upload-%d", msg.MessageID),
+			FileSize: len(content),
+			FilePath: fmt.Sprintf("uploads/%d", msg.MessageID),
+		}
+		s.files[f.FileID] = f
+		s.contents[f.FilePath] = content
+		if field == "photo" {
+			msg.Photo = &[]tgbotapi.PhotoSize{{FileID: f.FileID, FileSize: f.FileSize}}
+		} else {
+			msg.Document = &tgbotapi.Document{FileID: f.FileID, FileName: r.MultipartForm.File[field][0].Filename, FileSize: f.FileSize}
+		}
+		reply(w, http.StatusOK, msg, "")
+
+	case "editMessageText":
+		chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+		id, _ := strconv.Atoi(params.Get("message_id"))
+		old, ok := s.messages[chatID][id]
+		if !ok || old.From == nil || old.From.ID != Bot.ID {
+			reply(w, http.StatusBadRequest, nil, "Bad Request: message to edit not found")
+			return
+		}
+		if old.Text == "" {
+			reply(w, http.StatusBadRequest, nil, "Bad Request: there is no text in the message to edit")
+			return
+		}
+		msg := *old
+		if err := s.format(&msg, params); err != "" {
+			reply(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if msg.Text == old.Text {
+			reply(w, http.StatusBadRequest, nil, "Bad Request: message is not modified")
+			return
+		}
+		msg.EditDate = int(time.Now().Unix())
+		s.messages[chatID][id] = &msg
+		reply(w, http.StatusOK, &msg, "")
+
+	case "editMessageCaption":
+		chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+		id, _ := strconv.Atoi(params.Get("message_id"))
+		old, ok := s.messages[chatID][id]
+		if !ok || old.From == nil || old.From.ID != Bot.ID {
+			reply(w, http.StatusBadRequest, nil, "Bad Request: message to edit not found")
+			return
+		}
+		if old.Photo == nil && old.Document == nil {
+			reply(w, http.StatusBadRequest, nil, "Bad Request: there is no caption in the message to edit")
+			return
+		}
+		msg := *old
+		caption, err := s.caption(params)
+		if err != "" {
+			reply(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if caption == old.Caption {
+			reply(w, http.StatusBadRequest, nil, "Bad Request: message is not modified")
+			return
+		}
+		msg.Caption = caption
+		msg.EditDate = int(time.Now().Unix())
+		s.messages[chatID][id] = &msg
+		reply(w, http.StatusOK, &msg, "")
+
+	case "getFile":
+		f, ok := s.files[params.Get("file_id")]
+		if !ok {
+			reply(w, http.StatusBadRequest, nil, "Bad Request: invalid file_id")
+			return
+		}
+		reply(w, http.StatusOK, f, "")
+
+	case "setWebhook":
+		if params.Get("url") == "" {
+			s.webhook = nil
+		} else {
+			s.webhook = params
+		}
+		reply(w, http.StatusOK, true, "")
+
+	case "deleteWebhook":
+		s.webhook = nil
+		reply(w, http.StatusOK, true, "")
+
+	case "setChatDescription":
+		reply(w, http.StatusOK, true, "")
+
+	default:
+		reply(w, http.StatusNotFound, nil, "Not Found: method not found")
+	}
+}
+
+// getUpdates answers with updates newer than the given offset, waiting up to
+// the given timeout for some to appear.
+func (s *Server) getUpdates(w http.ResponseWriter, params url.Values) {
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	timeout, _ := strconv.Atoi(params.Get("timeout"))
+	deadline := time.After(time.Duration(timeout) * time.Second)
+	for {
+		s.mu.Lock()
+		if s.webhook != nil {
+			s.mu.Unlock()
+			reply(w, http.StatusConflict, nil, "Conflict: can't use getUpdates method while webhook is active; use deleteWebhook to delete the webhook first")
+			return
+		}
+		res := []tgbotapi.Update{}
+		for _, u := range s.updates {
+			if u.UpdateID >= offset {
+				res = append(res, u)
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(res) > 0 || timeout == 0 {
+			reply(w, http.StatusOK, res, "")
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			timeout = 0
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// format sets the text of a message from request parameters, checking its
+// formatting like Telegram does. An error description is returned if the
+// text is invalid.
+func (s *Server) format(m *tgbotapi.Message, params url.Values) string {
+	text := params.Get("text")
+	if strings.TrimSpace(text) == "" {
+		return "Bad Request: message text is empty"
+	}
+	if params.Get("parse_mode") == "HTML" {
+		plain, err := parseHTML(text)
+		if err != nil {
+			return "Bad Request: can't parse entities: " + err.Error()
+		}
+		text = plain
+	}
+	m.Text = text
+	return ""
+}
+
+// caption returns the caption of a media message from request parameters,
+// checking its formatting like Telegram does. An error description is
+// returned if the caption is invalid.
+func (s *Server) caption(params url.Values) (string, string) {
+	caption := params.Get("caption")
+	if params.Get("parse_mode") == "HTML" {
+		plain, err := parseHTML(caption)
+		if err != nil {
+			return "", "Bad Request: can't parse entities: " + err.Error()
+		}
+		caption = plain
+	}
+	return caption, ""
+}
+
+// replyTo sets the message a message replies to from request parameters. An
+// error description is returned if that message does not exist. It must be
+// called with mu held.
+func (s *Server) replyTo(m *tgbotapi.Message, params url.Values) string {
+	id := params.Get("reply_to_message_id")
+	if id == "" || id == "0" {
+		return ""
+	}
+	i, _ := strconv.Atoi(id)
+	replyTo, ok := s.messages[m.Chat.ID][i]
+	if !ok {
+		return "Bad Request: message to be replied not found"
+	}
+	m.ReplyToMessage = replyTo
+	return ""
+}
+
+// readFiles returns the contents of files uploaded in a multipart request, by
+// field name.
+func readFiles(r *http.Request) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if r.MultipartForm == nil {
+		return files, nil
+	}
+	for field, headers := range r.MultipartForm.File {
+		f, err := headers[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[field] = content
+	}
+	return files, nil
+}
+
+// reHTMLTag matches a tag or entity in Telegram HTML.
+var reHTMLTag = regexp.MustCompile(`<(/?)([a-z\-]+)[^>]*>|&([a-z]+|#[0-9]+);`)
+
+// htmlEntities are the named entities supported by Telegram.
+var htmlEntities = map[string]string{"lt": "<", "gt": ">", "amp": "&", "quot": "\""}
+
+// parseHTML validates Telegram HTML and returns its text, without tags.
+func parseHTML(text string) (string, error) {
+	allowed := map[string]bool{"b": true, "strong": true, "i": true, "em": true, "u": true, "ins": true,
+		"s": true, "strike": true, "del": true, "code": true, "pre": true, "a": true, "tg-spoiler": true}
+	stack := []string{}
+	var b strings.Builder
+	last := 0
+	for _, m := range reHTMLTag.FindAllStringSubmatchIndex(text, -1) {
+		between := text[last:m[0]]
+		if strings.ContainsAny(between, "<>&") {
+			return "", fmt.Errorf("unsupported start tag or unescaped character at byte offset %d", last)
+		}
+		b.WriteString(between)
+		last = m[1]
+
+		if m[6] != -1 {
+			// Entity.
+			e := text[m[6]:m[7]]
+			if strings.HasPrefix(e, "#") {
+				n, _ := strconv.Atoi(e[1:])
+				b.WriteRune(rune(n))
+				continue
+			}
+			r, ok := htmlEntities[e]
+			if !ok {
+				return "", fmt.Errorf("unsupported HTML entity %q", e)
+			}
+			b.WriteString(r)
+			continue
+		}
+
+		tag := text[m[4]:m[5]]
+		if !allowed[tag] {
+			return "", fmt.Errorf("unsupported start tag %q", tag)
+		}
+		if m[3] == m[2] {
+			stack = append(stack, tag)
+			continue
+		}
+		if len(stack) == 0 || stack[len(stack)-1] != tag {
+			return "", fmt.Errorf("unexpected end tag %q", tag)
+		}
+		stack = stack[:len(stack)-1]
+	}
+	rest := text[last:]
+	if strings.ContainsAny(rest, "<>&") {
+		return "", fmt.Errorf("unsupported start tag or unescaped character at byte offset %d", last)
+	}
+	b.WriteString(rest)
+	if len(stack) > 0 {
+		return "", fmt.Errorf("can't find end tag corresponding to start tag %q", stack[len(stack)-1])
+	}
+	return b.String(), nil
+}
+
+// reply writes a Bot API response, with a result if code is 200, or an error
+// description otherwise.
+func reply(w http.ResponseWriter, code int, result interface{}, description string) {
+	res := map[string]interface{}{
+		"ok": code == http.StatusOK,
+	}
+	if code == http.StatusOK {
+		res["result"] = result
+	} else {
+		res["error_code"] = code
+		res["description"] = description
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
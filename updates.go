@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// update is a Telegram update, along with the fields of its message that
+// tgbotapi does not know about.
+type update struct {
+	tgbotapi.Update
+	// extra fields of Update.Message, or nil
+	extra *messageExtra
+}
+
+// messageExtra are the fields of a Telegram message that are newer than
+// tgbotapi.
+type messageExtra struct {
+	Poll           *poll         `json:"poll"`
+	Dice           *dice         `json:"dice"`
+	ReplyToMessage *messageExtra `json:"reply_to_message"`
+	// ID of the album the message is part of.
+	MediaGroupID string `json:"media_group_id"`
+	// Origin of forwarded messages. Older Bot API versions only send the
+	// sender name (for users hiding their account) and signature (of channel
+	// posts), along with tgbotapi's ForwardFrom and ForwardFromChat; newer
+	// ones send forward_origin.
+	ForwardSenderName string         `json:"forward_sender_name"`
+	ForwardSignature  string         `json:"forward_signature"`
+	ForwardOrigin     *messageOrigin `json:"forward_origin"`
+}
+
+// messageOrigin is the origin of a forwarded message.
+type messageOrigin struct {
+	// "user", "hidden_user", "chat" or "channel"
+	Type string `json:"type"`
+	// Set for "user".
+	SenderUser *tgbotapi.User `json:"sender_user"`
+	// Set for "hidden_user".
+	SenderUserName string `json:"sender_user_name"`
+	// Set for "chat".
+	SenderChat *tgbotapi.Chat `json:"sender_chat"`
+	// Set for "channel".
+	Chat *tgbotapi.Chat `json:"chat"`
+	// Signature of the author in a chat or channel, if any.
+	AuthorSignature string `json:"author_signature"`
+}
+
+// poll is a native Telegram poll.
+type poll struct {
+	Question string       `json:"question"`
+	Options  []pollOption `json:"options"`
+	// "regular" or "quiz"
+	Type                  string `json:"type"`
+	AllowsMultipleAnswers bool   `json:"allows_multiple_answers"`
+}
+
+type pollOption struct {
+	Text       string `json:"text"`
+	VoterCount int    `json:"voter_count"`
+}
+
+// dice is an animated emoji with a random value, eg. a rolled die.
+type dice struct {
+	Emoji string `json:"emoji"`
+	Value int    `json:"value"`
+}
+
+// reply returns the extra fields of the message replied to, or nil.
+func (x *messageExtra) reply() *messageExtra {
+	if x == nil {
+		return nil
+	}
+	return x.ReplyToMessage
+}
+
+// poll returns the poll in a message, or nil.
+func (x *messageExtra) poll() *poll {
+	if x == nil {
+		return nil
+	}
+	return x.Poll
+}
+
+// dice returns the dice in a message, or nil.
+func (x *messageExtra) dice() *dice {
+	if x == nil {
+		return nil
+	}
+	return x.Dice
+}
+
+// mediaGroup returns the ID of the album a message is part of, or "".
+func (x *messageExtra) mediaGroup() string {
+	if x == nil {
+		return ""
+	}
+	return x.MediaGroupID
+}
+
+// parseUpdate decodes an update as sent by Telegram.
+func parseUpdate(data []byte) (*update, error) {
+	u := &update{}
+	if err := json.Unmarshal(data, &u.Update); err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Message *messageExtra `json:"message"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	u.extra = raw.Message
+	return u, nil
+}
+
+// getUpdates long-polls Telegram for updates starting at a given offset. Unlike
+// tgbotapi's, it returns the fields of messages that tgbotapi does not know
+// about, and can be cancelled.
+func (t *telegram) getUpdates(ctx context.Context, offset, timeout int) ([]*update, error) {
+	v := url.Values{}
+	v.Set("offset", strconv.Itoa(offset))
+	v.Set("timeout", strconv.Itoa(timeout))
+	endpoint := fmt.Sprintf(tgbotapi.APIEndpoint, t.tel.Token, "getUpdates")
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := t.tel.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var resp struct {
+		Ok          bool              `json:"ok"`
+		Description string            `json:"description"`
+		Result      []json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if !resp.Ok {
+		return nil, fmt.Errorf("%s", resp.Description)
+	}
+	updates := []*update{}
+	for _, data := range resp.Result {
+		u, err := parseUpdate(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing update: %v", err)
+		}
+		updates = append(updates, u)
+	}
+	return updates, nil
+}
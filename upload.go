@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/golang/glog"
+)
+
+// telegramUpload is media linked in a message from IRC, to be uploaded to
+// Telegram instead of sending the message as text.
+type telegramUpload struct {
+	// URL of the media.
+	URL string `json:"url"`
+	// HTML and plain text caption: the message without the link.
+	HTML  string `json:"html"`
+	Plain string `json:"plain"`
+}
+
+// uploadExtensions are the extensions of links that are uploaded to Telegram.
+var uploadExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp4": true, ".webm": true, ".mov": true,
+}
+
+// reLink matches links in messages from IRC.
+var reLink = regexp.MustCompile(`https?://[^\s\x00-\x1f]+`)
+
+const (
+	// maxCaption is the maximum length of a Telegram caption.
+	maxCaption = 1024
+	// maxPhotoSize is the maximum size of a photo uploaded to Telegram. Larger
+	// images are sent as documents.
+	maxPhotoSize = 10 << 20
+	// uploadTimeout is how long downloading media linked on IRC can take.
+	// It holds up all messages to Telegram, so it is kept short.
+	uploadTimeout = 15 * time.Second
+)
+
+// uploadURL returns the first link in a message that points directly at an
+// image or video, judging by its extension, or "".
+func uploadURL(text string) string {
+	for _, link := range reLink.FindAllString(ircStripped(text), -1) {
+		u, err := url.Parse(link)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		if uploadExtensions[strings.ToLower(path.Ext(u.Path))] {
+			return link
+		}
+	}
+	return ""
+}
+
+// ircStripped returns text without IRC formatting codes, which would otherwise
+// end up in links.
+func ircStripped(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+// uploadCaption returns the text of a message without a link in it.
+func uploadCaption(text, link string) string {
+	return strings.Join(strings.Fields(strings.Replace(text, link, "", 1)), " ")
+}
+
+// newUploadClient returns the HTTP client downloading media linked on IRC. As
+// links come from anyone on IRC, it refuses to connect to loopback, private
+// and link-local addresses, so that the bridge can't be made to fetch
+// internal resources.
+func newUploadClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: uploadTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// privateNets are the address ranges that are not reachable from the
+// internet.
+var privateNets = func() []*net.IPNet {
+	res := []*net.IPNet{}
+	for _, cidr := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		res = append(res, n)
+	}
+	return res
+}()
+
+// isPublicIP returns whether an address is reachable from the internet.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchUpload downloads media linked on IRC, checking that it is an image or
+// video of at most maxSize bytes. It returns the file, and whether it can be
+// sent as a photo.
+func fetchUpload(ctx context.Context, client *http.Client, link string, maxSize int64) (tgbotapi.FileBytes, bool, error) {
+	file := tgbotapi.FileBytes{}
+	u, err := url.Parse(link)
+	if err != nil {
+		return file, false, err
+	}
+	file.Name = path.Base(u.Path)
+
+	// Check what the link is before downloading it.
+	req, err := http.NewRequest(http.MethodHead, link, nil)
+	if err != nil {
+		return file, false, err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return file, false, err
+	}
+	res.Body.Close()
+	if err := checkUpload(res, maxSize); err != nil {
+		return file, false, err
+	}
+
+	req, err = http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return file, false, err
+	}
+	res, err = client.Do(req.WithContext(ctx))
+	if err != nil {
+		return file, false, err
+	}
+	defer res.Body.Close()
+	if err := checkUpload(res, maxSize); err != nil {
+		return file, false, err
+	}
+	file.Bytes, err = ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return file, false, err
+	}
+	if int64(len(file.Bytes)) > maxSize {
+		return file, false, fmt.Errorf("larger than %d bytes", maxSize)
+	}
+	t, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	photo := (t == "image/jpeg" || t == "image/png") && len(file.Bytes) <= maxPhotoSize
+	return file, photo, nil
+}
+
+// checkUpload checks the response to a request for media linked on IRC.
+func checkUpload(res *http.Response, maxSize int64) error {
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("got %s", res.Status)
+	}
+	t, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("invalid Content-Type: %v", err)
+	}
+	if !strings.HasPrefix(t, "image/") && !strings.HasPrefix(t, "video/") {
+		return fmt.Errorf("not an image or video, but %s", t)
+	}
+	if res.ContentLength > maxSize {
+		return fmt.Errorf("larger than %d bytes", maxSize)
+	}
+	return nil
+}
+
+// uploadTelegram uploads media linked in a message from IRC to Telegram, as a
+// photo or document captioned with the rest of the message. Like
+// sendTelegram, it falls back to a plain text caption and to not replying. It
+// returns the ID of the sent message.
+func (s *server) uploadTelegram(ctx context.Context, up *telegramUpload, replyTo int) (int, error) {
+	if utf8.RuneCountInString(up.Plain) > maxCaption {
+		return 0, fmt.Errorf("caption too long")
+	}
+	ctxT, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+	file, photo, err := fetchUpload(ctxT, s.uploadClient, up.URL, flagIRCUploadMaxSize)
+	if err != nil {
+		return 0, fmt.Errorf("fetching %s: %v", up.URL, err)
+	}
+
+	caption, parseMode := up.HTML, "HTML"
+	for {
+		var c tgbotapi.Chattable
+		if photo {
+			p := tgbotapi.NewPhotoUpload(s.groupId, file)
+			p.Caption, p.ParseMode, p.ReplyToMessageID = caption, parseMode, replyTo
+			c = p
+		} else {
+			d := tgbotapi.NewDocumentUpload(s.groupId, file)
+			d.Caption, d.ParseMode, d.ReplyToMessageID = caption, parseMode, replyTo
+			c = d
+		}
+		glog.V(16).Infof("bridge/debug16: Uploading %s (%d bytes)", up.URL, len(file.Bytes))
+		m, err := s.tel.Send(c)
+		switch {
+		case err == nil:
+			return m.MessageID, nil
+		case replyTo != 0 && isReplyError(err):
+			glog.Warningf("bridge: Replied-to message is gone, uploading without reply: %s", err)
+			replyTo = 0
+		case parseMode != "" && isParseError(err):
+			glog.Warningf("bridge: Cannot upload with HTML caption to telegram, using plain text: %s", err)
+			caption, parseMode = up.Plain, ""
+		default:
+			return 0, err
+		}
+	}
+}
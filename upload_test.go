@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUploadURL(t *testing.T) {
+	for _, test := range []struct {
+		text, want string
+	}{
+		{"https://example.com/cat.jpg", "https://example.com/cat.jpg"},
+		{"look: http://example.com/a/b.PNG?size=large too", "http://example.com/a/b.PNG?size=large"},
+		{"\x02https://example.com/cat.gif\x02", "https://example.com/cat.gif"},
+		{"https://example.com/page.html https://example.com/clip.mp4", "https://example.com/clip.mp4"},
+		{"https://example.com/cat.jpg.html", ""},
+		{"https://example.com/", ""},
+		{"cat.jpg", ""},
+	} {
+		if got := uploadURL(test.text); got != test.want {
+			t.Errorf("uploadURL(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+// deliverUpload delivers a message from bob linking to url on the bridge,
+// after a given number of failed attempts, and returns the Telegram message it
+// was delivered as.
+func deliverUpload(t *testing.T, s *server, url string, attempts int) int {
+	t.Helper()
+	text := "look " + url
+	html, plain := ircToTelegram("bob", text, false, false, nil)
+	chtml, cplain := ircToTelegram("bob", uploadCaption(text, url), false, false, nil)
+	payload, _ := json.Marshal(&telegramOutbound{
+		HTML:   html,
+		Plain:  plain,
+		Upload: &telegramUpload{URL: url, HTML: chtml, Plain: cplain},
+		Entry:  &messageEntry{Nick: "bob", Text: text},
+	})
+	if err := s.deliverTelegram(context.Background(), payload, attempts); err != nil {
+		t.Fatalf("deliverTelegram: %v", err)
+	}
+	e := s.msgs.last(func(e *messageEntry) bool { return e.Nick == "bob" })
+	if e == nil {
+		t.Fatalf("message not recorded")
+	}
+	return e.TelegramID
+}
+
+func TestUploadTelegram(t *testing.T) {
+	fake, _, s := newTestBridge(t)
+	s.uploadClient = http.DefaultClient
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cat.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+		case "/clip.webm":
+			w.Header().Set("Content-Type", "video/webm")
+			w.Write([]byte("webm"))
+		case "/page.jpg":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>"))
+		case "/huge.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(bytes.Repeat([]byte{0}, 2000))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer web.Close()
+	defer func(max int64) { flagIRCUploadMaxSize = max }(flagIRCUploadMaxSize)
+	flagIRCUploadMaxSize = 1000
+
+	id := deliverUpload(t, s, web.URL+"/cat.png", 0)
+	calls := fake.Calls("sendPhoto")
+	if len(calls) != 1 {
+		t.Fatalf("got %d sendPhoto calls, want 1", len(calls))
+	}
+	if got := calls[0].Files["photo"]; !bytes.Equal(got, png) {
+		t.Errorf("uploaded %q, want %q", got, png)
+	}
+	if got := fake.Message(testChat, id); got == nil || got.Photo == nil || got.Caption != "<bob> look" {
+		t.Errorf("got message %+v, want photo captioned <bob> look", got)
+	}
+
+	id = deliverUpload(t, s, web.URL+"/clip.webm", 0)
+	if got := fake.Message(testChat, id); got == nil || got.Document == nil || got.Document.FileName != "clip.webm" {
+		t.Errorf("got message %+v, want document clip.webm", got)
+	}
+
+	// Links that aren't media, are too large or broken are sent as text.
+	for _, path := range []string{"/page.jpg", "/huge.jpg", "/gone.jpg"} {
+		id = deliverUpload(t, s, web.URL+path, 0)
+		if got, want := fake.Message(testChat, id).Text, "<bob> look "+web.URL+path; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	// So is media when retrying a message.
+	id = deliverUpload(t, s, web.URL+"/cat.png", 1)
+	if got, want := fake.Message(testChat, id).Text, "<bob> look "+web.URL+"/cat.png"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if n := len(fake.Calls("sendPhoto")) + len(fake.Calls("sendDocument")); n != 2 {
+		t.Errorf("got %d uploads, want 2", n)
+	}
+}
+
+func TestUploadCorrection(t *testing.T) {
+	fake, _, s := newTestBridge(t)
+	s.uploadClient = http.DefaultClient
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer web.Close()
+	defer func(max int64) { flagIRCUploadMaxSize = max }(flagIRCUploadMaxSize)
+	flagIRCUploadMaxSize = 1000
+
+	// Corrections of uploaded media edit its caption.
+	id := deliverUpload(t, s, web.URL+"/cat.png", 0)
+	if !s.correctTelegram("bob", "s/look/see/", nil) {
+		t.Fatalf("correction not applied")
+	}
+	if got := fake.Message(testChat, id).Caption; got != "<bob> see" {
+		t.Errorf("got caption %q, want <bob> see", got)
+	}
+	// Those of the link itself are not applied.
+	if s.correctTelegram("bob", "s/cat.png/dog.png/", nil) {
+		t.Errorf("correction of link applied")
+	}
+}
+
+func TestUploadClientPrivate(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+	}))
+	defer web.Close()
+	if _, _, err := fetchUpload(context.Background(), newUploadClient(), web.URL+"/cat.png", 1000); err == nil {
+		t.Errorf("fetched media from a loopback address")
+	}
+}
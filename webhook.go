@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// webhookSecretHeader is the header in which Telegram sends the secret token
+// given to setWebhook.
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// webhookSecret returns the secret token that Telegram must send along with
+// webhook updates: either the one given by flag, or a random one.
+func webhookSecret() (string, error) {
+	if flagTelegramWebhookSecret != "" {
+		return flagTelegramWebhookSecret, nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webhook receives updates from Telegram through a webhook served by an
+// embedded HTTP(S) server, and pipes resulting messages into the bridges'
+// telLogs, like connection does. The webhook is set when starting, and deleted
+// when ctx is done.
+func (t *telegram) webhook(ctx context.Context) error {
+	u, err := url.Parse(flagTelegramWebhookURL)
+	if err != nil {
+		return fmt.Errorf("parsing telegram_webhook_url: %v", err)
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	secret, err := webhookSecret()
+	if err != nil {
+		return fmt.Errorf("generating webhook secret: %v", err)
+	}
+
+	updates := make(chan *update)
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookSecretHeader)), []byte(secret)) != 1 {
+			glog.Warningf("telegram/webhook: rejected update from %s with invalid secret token", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		update, err := parseUpdate(body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		select {
+		case updates <- update:
+		case <-r.Context().Done():
+			// Telegram will retry.
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	})
+	srv := &http.Server{
+		Addr:    flagTelegramWebhookListen,
+		Handler: mux,
+		// Updates are small, and Telegram retries them.
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if flagTelegramWebhookCert != "" {
+			serveErr <- srv.ListenAndServeTLS(flagTelegramWebhookCert, flagTelegramWebhookKey)
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	defer func() {
+		ctxS, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctxS)
+	}()
+
+	_, err = t.tel.MakeRequest("setWebhook", url.Values{
+		"url":          {flagTelegramWebhookURL},
+		"secret_token": {secret},
+	})
+	if err != nil {
+		return fmt.Errorf("setWebhook: %v", err)
+	}
+	glog.Infof("Receiving Telegram updates through webhook %s on %s", flagTelegramWebhookURL, flagTelegramWebhookListen)
+
+	for {
+		select {
+		case <-ctx.Done():
+			if _, err := t.tel.MakeRequest("deleteWebhook", url.Values{}); err != nil {
+				glog.Errorf("Could not delete webhook: %v", err)
+			}
+			return ctx.Err()
+		case err := <-serveErr:
+			return fmt.Errorf("serving webhook: %v", err)
+		case update := <-updates:
+			t.dispatch(update)
+		}
+	}
+}